@@ -2,21 +2,53 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"net"
+	"net/http"
 	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	"github.com/goccy/go-json"
+	"github.com/hashicorp/go-hclog"
 	hplugin "github.com/hashicorp/go-plugin"
 	easyrest "github.com/onegreyonewhite/easyrest/plugin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"gopkg.in/yaml.v3"
 )
 
 var Version = "v0.6.2"
@@ -29,8 +61,18 @@ type rowScanner interface {
 	Err() error
 }
 
+// columnTyper is implemented by *sql.Rows; scanRows uses it to encode values by column type.
+type columnTyper interface {
+	ColumnTypes() ([]*sql.ColumnType, error)
+}
+
+// queryer is implemented by *sql.DB, *sql.Conn and *sql.Tx.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
 // openDB is a package variable so we can override in tests (to return a sqlmock DB).
-var openDB = sql.Open
+var openDB = sql.OpenDB
 
 // RoutineParam holds one parameter definition.
 type RoutineParam struct {
@@ -45,6 +87,34 @@ type RoutineInfo struct {
 	Name       string
 	Params     []RoutineParam
 	ReturnType string
+	DataAccess string // SQL_DATA_ACCESS, loaded only when replicas are configured
+}
+
+// softDeleteConfig describes how rows of a table are marked as deleted instead of being removed.
+type softDeleteConfig struct {
+	Column string
+	Mode   string // "timestamp" (column = NOW()) or "flag" (column = 1)
+}
+
+// activeCondition returns the SQL condition matching rows that are not soft-deleted.
+// A non-empty alias qualifies the column, as in correlated subqueries.
+func (c softDeleteConfig) activeCondition(alias string) string {
+	column := c.Column
+	if alias != "" {
+		column = alias + "." + column
+	}
+	if c.Mode == "flag" {
+		return column + " = 0"
+	}
+	return column + " IS NULL"
+}
+
+// deleteAssignment returns the SET expression used to soft-delete a row.
+func (c softDeleteConfig) deleteAssignment() string {
+	if c.Mode == "flag" {
+		return c.Column + " = 1"
+	}
+	return c.Column + " = NOW()"
 }
 
 // mysqlPlugin implements easyrest.DBPlugin for MySQL.
@@ -52,6 +122,193 @@ type mysqlPlugin struct {
 	db             *sql.DB
 	routines       map[string]RoutineInfo
 	defaultTimeout time.Duration
+	softDelete     map[string]softDeleteConfig
+	isolationLevel sql.IsolationLevel
+	readSnapshot   bool
+	maxRetries     int
+	retryBackoff   time.Duration
+	replicas       []*replica
+	replicaNext    atomic.Uint64
+	replicaStop    chan struct{} // closed to stop the health check of the current replicas
+	failover       *failoverConnector
+	maxIdleConns   int
+	userSecret     *secretValue
+	passwordSecret *secretValue
+	session        []string // statements run on every new connection
+	metrics        *metrics
+	metricsServer  *http.Server
+	slowLog        *slowQueryLog
+	dbName         string
+	tracer         trace.Tracer
+	tracerProvider *sdktrace.TracerProvider
+	explainClaim   string // dotted path of the claim checked for explainRole
+	explainRole    string // claim value allowed to request query plans; empty disables them
+	logger         hclog.Logger
+	access         *accessRules
+	audit          *auditLog
+	tenants        *tenantRouting
+	schemas        []string                          // schemas exposed as schema.name
+	schemaRoutines map[string]map[string]RoutineInfo // routines of the schemas, by schema
+	maxEmbedDepth  int                               // nesting limit of embedded resources; 0 disables them
+	relations      *relationCache
+}
+
+// isolationLevelNames maps the supported isolation levels to their MySQL names.
+var isolationLevelNames = map[sql.IsolationLevel]string{
+	sql.LevelReadUncommitted: "READ UNCOMMITTED",
+	sql.LevelReadCommitted:   "READ COMMITTED",
+	sql.LevelRepeatableRead:  "REPEATABLE READ",
+	sql.LevelSerializable:    "SERIALIZABLE",
+}
+
+// parseIsolationLevel converts an isolation level name such as "READ COMMITTED",
+// "read_committed" or "read-committed" into sql.IsolationLevel.
+func parseIsolationLevel(val string) (sql.IsolationLevel, error) {
+	name := strings.ToUpper(strings.NewReplacer("_", " ", "-", " ").Replace(strings.TrimSpace(val)))
+	if name == "" || name == "DEFAULT" {
+		return sql.LevelDefault, nil
+	}
+	for level, levelName := range isolationLevelNames {
+		if levelName == name {
+			return level, nil
+		}
+	}
+	return sql.LevelDefault, newDBError(errValidation, fmt.Errorf("invalid isolation level: %s (expected READ UNCOMMITTED, READ COMMITTED, REPEATABLE READ or SERIALIZABLE)", val))
+}
+
+// txOptions resolves transaction options from the URI defaults and the "isolation" preference of the request.
+func (m *mysqlPlugin) txOptions(ctx map[string]any) (*sql.TxOptions, error) {
+	opts := &sql.TxOptions{Isolation: m.isolationLevel}
+	if val := getPreference(ctx, "isolation"); val != "" {
+		level, err := parseIsolationLevel(val)
+		if err != nil {
+			return nil, err
+		}
+		opts.Isolation = level
+	}
+	return opts, nil
+}
+
+// useReadSnapshot reports whether TableGet should run inside a read-only consistent snapshot.
+// The "snapshot" preference of the request overrides the readSnapshot URI default.
+func (m *mysqlPlugin) useReadSnapshot(ctx map[string]any) (bool, error) {
+	val := getPreference(ctx, "snapshot")
+	if val == "" {
+		return m.readSnapshot, nil
+	}
+	snapshot, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, newDBError(errValidation, fmt.Errorf("invalid snapshot preference: %s", val))
+	}
+	return snapshot, nil
+}
+
+// explainRequested reports whether the request asks for the query plan instead of the result
+// through the "explain" preference. Only callers whose explainClaim holds explainRole may do so.
+func (m *mysqlPlugin) explainRequested(ctx map[string]any) (bool, error) {
+	val := getPreference(ctx, "explain")
+	if val == "" {
+		return false, nil
+	}
+	explain, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, newDBError(errValidation, fmt.Errorf("invalid explain preference: %s", val))
+	}
+	if !explain {
+		return false, nil
+	}
+	if m.explainRole == "" {
+		return false, newDBError(errPermissionDenied, errors.New("query plans are not enabled"))
+	}
+	if !hasClaimValue(ctx, m.explainClaim, m.explainRole) {
+		return false, newDBError(errPermissionDenied, fmt.Errorf("query plans require the %s claim %q", m.explainClaim, m.explainRole))
+	}
+	return true, nil
+}
+
+// hasClaimValue reports whether the claim at the dotted path in ctx["claims"] equals want
+// or, for a list or a space-separated string such as an OAuth scope, contains it.
+func hasClaimValue(ctx map[string]any, path, want string) bool {
+	var claim any = ctx["claims"]
+	for _, key := range strings.Split(path, ".") {
+		claims, ok := claim.(map[string]any)
+		if !ok {
+			return false
+		}
+		claim = claims[key]
+	}
+	switch v := claim.(type) {
+	case string:
+		return slices.Contains(strings.Fields(v), want)
+	case []string:
+		return slices.Contains(v, want)
+	case []any:
+		for _, item := range v {
+			if s, ok := item.(string); ok && s == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// explainQuery returns the EXPLAIN FORMAT=JSON plan of query with args run through q.
+func (m *mysqlPlugin) explainQuery(ctx context.Context, q queryer, query string, args []any) (any, error) {
+	explainQ := "EXPLAIN FORMAT=JSON " + query
+	queryCtx, span := m.startSpan(ctx, "explain", trace.WithAttributes(semconv.DBQueryText(explainQ)))
+	rows, err := q.QueryContext(queryCtx, explainQ, args...)
+	endSpan(span, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to explain query: %w", err)
+	}
+	defer rows.Close()
+	results, err := m.scanRows(ctx, rows)
+	if err != nil {
+		return nil, err
+	}
+	return planOf(results), nil
+}
+
+// planOf extracts the plan from the single EXPLAIN FORMAT=JSON row.
+func planOf(results []map[string]any) any {
+	if len(results) == 0 {
+		return nil
+	}
+	for _, v := range results[0] {
+		return v
+	}
+	return nil
+}
+
+// planError returns the plan of a write statement that was not executed. Writes can only return
+// a row count, so the plan is carried in the error text as the JSON object a GET returns.
+func planError(query string, args []any, plan any) error {
+	data, err := json.Marshal(map[string]any{"query": query, "args": args, "plan": plan})
+	if err != nil {
+		return fmt.Errorf("failed to encode query plan: %w", err)
+	}
+	return newDBError(errQueryPlan, fmt.Errorf("statement not executed: %s", data))
+}
+
+// log returns the logger of the plugin, which discards everything before InitConnection.
+func (m *mysqlPlugin) log() hclog.Logger {
+	if m.logger == nil {
+		return hclog.NewNullLogger()
+	}
+	return m.logger
+}
+
+// beginReadSnapshot starts a read-only transaction with a consistent snapshot on conn.
+func beginReadSnapshot(ctx context.Context, conn *sql.Conn, level sql.IsolationLevel) error {
+	if name, ok := isolationLevelNames[level]; ok {
+		if _, err := conn.ExecContext(ctx, "SET TRANSACTION ISOLATION LEVEL "+name); err != nil {
+			return fmt.Errorf("failed to set isolation level: %w", err)
+		}
+	}
+	if _, err := conn.ExecContext(ctx, "START TRANSACTION READ ONLY WITH CONSISTENT SNAPSHOT"); err != nil {
+		return fmt.Errorf("failed to start read-only transaction: %w", err)
+	}
+	return nil
 }
 
 // injectContext sets *all* keys from ctx under two prefixes: erctx_ and request_.
@@ -112,58 +369,2725 @@ func (m *mysqlPlugin) injectContext(conn *sql.Conn, ctx map[string]any) error {
 	return nil
 }
 
-// scanRows converts row data into []map[string]any.
-// Pre-allocates memory for results with a capacity of 100 for better performance.
-func scanRows(r rowScanner) ([]map[string]any, error) {
-	cols, err := r.Columns()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get columns: %w", err)
+// getPreference returns the value of a Prefer header token propagated in the ctx map.
+func getPreference(ctx map[string]any, key string) string {
+	if ctx == nil {
+		return ""
 	}
-	numCols := len(cols)
-	results := make([]map[string]any, 0, 100) // Pre-allocate memory for results
-	columns := make([]any, numCols)
-	pointers := make([]any, numCols)
-	for i := range columns {
-		pointers[i] = &columns[i]
+	prefer, ok := ctx["prefer"].(map[string]any)
+	if !ok {
+		return ""
 	}
+	if val, ok := prefer[key]; ok && val != nil {
+		return fmt.Sprint(val)
+	}
+	return ""
+}
 
-	for r.Next() {
-		if err := r.Scan(pointers...); err != nil {
-			return nil, fmt.Errorf("failed to scan row: %w", err)
+// appendCondition ANDs raw SQL conditions onto a WHERE clause built by easyrest.BuildWhereClauseSorted.
+// The existing clause is parenthesized so that an OR in it cannot bypass conds.
+func appendCondition(whereClause string, conds ...string) string {
+	if len(conds) == 0 {
+		return whereClause
+	}
+	cond := strings.Join(conds, " AND ")
+	if whereClause == "" {
+		return " WHERE " + cond
+	}
+	return " WHERE (" + strings.TrimPrefix(whereClause, " WHERE ") + ") AND " + cond
+}
+
+// parseSoftDelete parses the softDelete URI parameter: "table:column[:mode],...".
+// Mode is "timestamp" (default) or "flag".
+func parseSoftDelete(val string) (map[string]softDeleteConfig, error) {
+	result := make(map[string]softDeleteConfig)
+	for _, entry := range strings.Split(val, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
 		}
-		rowMap := make(map[string]any, numCols)
-		for i, colName := range cols {
-			val := columns[i]
-			if t, ok := val.(time.Time); ok {
-				if t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 && t.Nanosecond() == 0 {
-					rowMap[colName] = t.Format("2006-01-02")
-				} else {
-					rowMap[colName] = t.Format("2006-01-02 15:04:05")
-				}
-			} else if b, ok := val.([]byte); ok {
-				// Attempt to unmarshal as JSON
-				var jsonData any
-				err := json.Unmarshal(b, &jsonData)
-				if err == nil {
-					// If successful, use the unmarshaled data
-					rowMap[colName] = jsonData
-				} else {
-					// If not JSON, treat as a regular string
-					rowMap[colName] = string(b)
+		parts := strings.Split(entry, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid softDelete entry: %s", entry)
+		}
+		if !reColumnName.MatchString(parts[1]) {
+			return nil, fmt.Errorf("invalid softDelete column for %s: %q", parts[0], parts[1])
+		}
+		cfg := softDeleteConfig{Column: parts[1], Mode: "timestamp"}
+		if len(parts) == 3 {
+			cfg.Mode = strings.ToLower(parts[2])
+		}
+		if cfg.Mode != "timestamp" && cfg.Mode != "flag" {
+			return nil, fmt.Errorf("invalid softDelete mode for %s: %s", parts[0], parts[2])
+		}
+		result[parts[0]] = cfg
+	}
+	return result, nil
+}
+
+// Operations that tablePermissions can grant on a table.
+const (
+	opSelect = "select"
+	opInsert = "insert"
+	opUpdate = "update"
+	opDelete = "delete"
+)
+
+// accessRules hides tables, views, routines and columns from the schema and from every request,
+// limits the operations allowed on tables, restricts their rows with policies and masks column values. Names are matched as path.Match patterns,
+// so "tmp_*" hides every table starting with tmp_. Allow lists match exactly; every rule that restricts access matches
+// case-insensitively, since MySQL column and routine names (and table names with lower_case_table_names) are.
+// All methods allow everything on a nil *accessRules.
+type accessRules struct {
+	AllowTables   []string                 `yaml:"allowTables"` // when set, only matching tables and views are exposed
+	DenyTables    []string                 `yaml:"denyTables"`
+	AllowRoutines []string                 `yaml:"allowRoutines"` // when set, only matching routines are exposed
+	DenyRoutines  []string                 `yaml:"denyRoutines"`
+	DenyColumns   []string                 `yaml:"denyColumns"` // column or table.column
+	Permissions   map[string][]string      `yaml:"permissions"` // table => allowed operations
+	Policies      map[string][]rowPolicy   `yaml:"policies"`    // table => row policies
+	Masks         []columnMask             `yaml:"masks"`
+	AuditColumns  map[string][]auditColumn `yaml:"auditColumns"` // table => columns set from the context
+	maskKey       []byte                   // HMAC key of hash masks, from maskSecret
+}
+
+// auditColumn is set by TableCreate and TableUpdate from a value of the request context,
+// overriding any value sent by the client.
+type auditColumn struct {
+	Column     string   `yaml:"column"`
+	Value      string   `yaml:"value"`      // flattened context key such as claims_sub, or erctx.<key> / request.<path>
+	Operations []string `yaml:"operations"` // insert and/or update, default: both
+}
+
+// Masking modes of columnMask.
+const (
+	maskNull    = "null"    // the value is replaced by null
+	maskPartial = "partial" // all but the last 4 characters, or the first character of an e-mail, are replaced by *
+	maskHash    = "hash"    // the value is replaced by its HMAC-SHA256 hex digest keyed with maskSecret
+)
+
+// columnMask masks the values of matching columns in TableGet results for every caller
+// except those whose Claim holds one of UnmaskRoles.
+type columnMask struct {
+	Column      string   `yaml:"column"` // column or table.column
+	Mode        string   `yaml:"mode"`
+	UnmaskRoles []string `yaml:"unmaskRoles"`
+	Claim       string   `yaml:"claim"` // default: role
+}
+
+// rowPolicy limits the rows of a table visible to, and written by, a request to those whose Column
+// equals a value of the request context. Callers whose BypassClaim holds BypassRole are not restricted.
+type rowPolicy struct {
+	Column      string   `yaml:"column"`
+	Value       string   `yaml:"value"`      // erctx.<key> or request.<path>, e.g. erctx.claims_sub
+	Operations  []string `yaml:"operations"` // default: select, insert, update and delete
+	BypassRole  string   `yaml:"bypassRole"`
+	BypassClaim string   `yaml:"bypassClaim"` // default: role
+}
+
+var reColumnName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$]*$`)
+
+// newAccessRules reads the rules from the file named by accessFile and from the allowTables, denyTables,
+// allowRoutines, denyRoutines, denyColumns, tablePermissions, rowPolicies, policyBypassRole,
+// policyBypassClaim, maskColumns, unmaskRole, unmaskClaim, maskSecret and auditColumns URI parameters, removing them
+// from params. Lists are merged; URI permissions override those of the same table in the file,
+// URI policies, masks and audit columns are added to them.
+// It returns nil when nothing is configured.
+func newAccessRules(params url.Values) (*accessRules, error) {
+	rules := &accessRules{}
+	if file := params.Get("accessFile"); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read accessFile: %w", err)
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(rules); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("failed to parse accessFile: %w", err)
+		}
+	}
+	params.Del("accessFile")
+
+	lists := []struct {
+		name string
+		dst  *[]string
+	}{
+		{"allowTables", &rules.AllowTables},
+		{"denyTables", &rules.DenyTables},
+		{"allowRoutines", &rules.AllowRoutines},
+		{"denyRoutines", &rules.DenyRoutines},
+		{"denyColumns", &rules.DenyColumns},
+	}
+	for _, list := range lists {
+		for _, name := range strings.Split(params.Get(list.name), ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				*list.dst = append(*list.dst, name)
+			}
+		}
+		params.Del(list.name)
+	}
+
+	if val := params.Get("tablePermissions"); val != "" {
+		if rules.Permissions == nil {
+			rules.Permissions = make(map[string][]string)
+		}
+		for _, entry := range strings.Split(val, ",") {
+			if entry = strings.TrimSpace(entry); entry == "" {
+				continue
+			}
+			table, ops, ok := strings.Cut(entry, ":")
+			if !ok || table == "" {
+				return nil, fmt.Errorf("invalid tablePermissions entry: %s (expected table:operation|operation)", entry)
+			}
+			rules.Permissions[table] = strings.Split(ops, "|")
+		}
+		params.Del("tablePermissions")
+	}
+
+	if val := params.Get("rowPolicies"); val != "" {
+		if rules.Policies == nil {
+			rules.Policies = make(map[string][]rowPolicy)
+		}
+		for _, entry := range strings.Split(val, ",") {
+			if entry = strings.TrimSpace(entry); entry == "" {
+				continue
+			}
+			table, cond, _ := strings.Cut(entry, ":")
+			column, value, ok := strings.Cut(cond, "=")
+			if !ok || table == "" {
+				return nil, fmt.Errorf("invalid rowPolicies entry: %s (expected table:column=erctx.key)", entry)
+			}
+			rules.Policies[table] = append(rules.Policies[table], rowPolicy{Column: strings.TrimSpace(column), Value: strings.TrimSpace(value)})
+		}
+		params.Del("rowPolicies")
+	}
+	bypassRole, bypassClaim := params.Get("policyBypassRole"), params.Get("policyBypassClaim")
+	params.Del("policyBypassRole")
+	params.Del("policyBypassClaim")
+
+	if val := params.Get("maskColumns"); val != "" {
+		for _, entry := range strings.Split(val, ",") {
+			if entry = strings.TrimSpace(entry); entry == "" {
+				continue
+			}
+			column, mode, ok := strings.Cut(entry, ":")
+			if !ok || column == "" {
+				return nil, fmt.Errorf("invalid maskColumns entry: %s (expected column:mode)", entry)
+			}
+			rules.Masks = append(rules.Masks, columnMask{Column: column, Mode: mode})
+		}
+		params.Del("maskColumns")
+	}
+	unmaskRole, unmaskClaim := params.Get("unmaskRole"), params.Get("unmaskClaim")
+	params.Del("unmaskRole")
+	params.Del("unmaskClaim")
+	if secret := params.Get("maskSecret"); secret != "" {
+		rules.maskKey = []byte(secret)
+	}
+	params.Del("maskSecret")
+
+	if val := params.Get("auditColumns"); val != "" {
+		if rules.AuditColumns == nil {
+			rules.AuditColumns = make(map[string][]auditColumn)
+		}
+		for _, entry := range strings.Split(val, ",") {
+			if entry = strings.TrimSpace(entry); entry == "" {
+				continue
+			}
+			table, rest, _ := strings.Cut(entry, ":")
+			column, rest, ok := strings.Cut(rest, "=")
+			if !ok || table == "" {
+				return nil, fmt.Errorf("invalid auditColumns entry: %s (expected table:column=key[:operation|operation])", entry)
+			}
+			col := auditColumn{Column: column}
+			value, ops, hasOps := strings.Cut(rest, ":")
+			col.Value = value
+			if hasOps {
+				col.Operations = strings.Split(ops, "|")
+			}
+			rules.AuditColumns[table] = append(rules.AuditColumns[table], col)
+		}
+		params.Del("auditColumns")
+	}
+
+	patterns := slices.Concat(rules.AllowTables, rules.DenyTables, rules.AllowRoutines, rules.DenyRoutines, rules.DenyColumns)
+	for table, ops := range rules.Permissions {
+		patterns = append(patterns, table)
+		if err := normalizeOperations(ops); err != nil {
+			return nil, fmt.Errorf("invalid permission for %s: %w", table, err)
+		}
+	}
+	for table, policies := range rules.Policies {
+		patterns = append(patterns, table)
+		for i := range policies {
+			policy := &policies[i]
+			if !reColumnName.MatchString(policy.Column) {
+				return nil, fmt.Errorf("invalid policy for %s: invalid column %q", table, policy.Column)
+			}
+			if !strings.HasPrefix(policy.Value, "erctx.") && !strings.HasPrefix(policy.Value, "request.") {
+				return nil, fmt.Errorf("invalid policy for %s: value %q must start with erctx. or request.", table, policy.Value)
+			}
+			if len(policy.Operations) == 0 {
+				policy.Operations = []string{opSelect, opInsert, opUpdate, opDelete}
+			}
+			if err := normalizeOperations(policy.Operations); err != nil {
+				return nil, fmt.Errorf("invalid policy for %s: %w", table, err)
+			}
+			if policy.BypassRole == "" {
+				policy.BypassRole = bypassRole
+			}
+			if policy.BypassClaim == "" {
+				policy.BypassClaim = cmp.Or(bypassClaim, "role")
+			}
+		}
+	}
+	for table, columns := range rules.AuditColumns {
+		patterns = append(patterns, table)
+		for i := range columns {
+			col := &columns[i]
+			if !reColumnName.MatchString(col.Column) {
+				return nil, fmt.Errorf("invalid audit column for %s: %q", table, col.Column)
+			}
+			if col.Value == "" {
+				return nil, fmt.Errorf("invalid audit column %s.%s: missing context key", table, col.Column)
+			}
+			if len(col.Operations) == 0 {
+				col.Operations = []string{opInsert, opUpdate}
+			}
+			if err := normalizeOperations(col.Operations); err != nil {
+				return nil, fmt.Errorf("invalid audit column %s.%s: %w", table, col.Column, err)
+			}
+			for _, op := range col.Operations {
+				if op != opInsert && op != opUpdate {
+					return nil, fmt.Errorf("invalid audit column %s.%s: operation %q (expected insert or update)", table, col.Column, op)
 				}
-			} else {
-				rowMap[colName] = val
 			}
 		}
-		results = append(results, rowMap)
 	}
-	if err := r.Err(); err != nil {
-		return nil, fmt.Errorf("row iteration error: %w", err)
+	for i := range rules.Masks {
+		mask := &rules.Masks[i]
+		patterns = append(patterns, mask.Column)
+		mask.Mode = strings.ToLower(strings.TrimSpace(mask.Mode))
+		if mask.Mode != maskNull && mask.Mode != maskPartial && mask.Mode != maskHash {
+			return nil, fmt.Errorf("invalid mask for %s: unknown mode %q (expected null, partial or hash)", mask.Column, mask.Mode)
+		}
+		if mask.Mode == maskHash && len(rules.maskKey) == 0 {
+			// An unkeyed digest of a guessable value can be reversed by hashing every candidate.
+			return nil, fmt.Errorf("invalid mask for %s: hash mode requires maskSecret", mask.Column)
+		}
+		if len(mask.UnmaskRoles) == 0 && unmaskRole != "" {
+			mask.UnmaskRoles = []string{unmaskRole}
+		}
+		if mask.Claim == "" {
+			mask.Claim = cmp.Or(unmaskClaim, "role")
+		}
+	}
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid access pattern %q: %w", pattern, err)
+		}
+	}
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	return rules, nil
+}
+
+// normalizeOperations lowercases ops and checks that they are known operations.
+func normalizeOperations(ops []string) error {
+	for i, op := range ops {
+		op = strings.ToLower(strings.TrimSpace(op))
+		if op != opSelect && op != opInsert && op != opUpdate && op != opDelete {
+			return fmt.Errorf("unknown operation %q (expected select, insert, update or delete)", op)
+		}
+		ops[i] = op
+	}
+	return nil
+}
+
+// matchAny reports whether name matches one of patterns.
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchFold reports whether name matches pattern, ignoring case.
+func matchFold(pattern, name string) bool {
+	ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(name))
+	return ok
+}
+
+// matchAnyFold reports whether name matches one of patterns, ignoring case.
+func matchAnyFold(patterns []string, name string) bool {
+	return slices.ContainsFunc(patterns, func(pattern string) bool { return matchFold(pattern, name) })
+}
+
+// tableVisible reports whether the table or view is exposed.
+func (r *accessRules) tableVisible(table string) bool {
+	if r == nil {
+		return true
+	}
+	if len(r.AllowTables) > 0 && !matchAny(r.AllowTables, table) {
+		return false
+	}
+	return !matchAnyFold(r.DenyTables, table)
+}
+
+// routineVisible reports whether the routine is exposed.
+func (r *accessRules) routineVisible(routine string) bool {
+	if r == nil {
+		return true
+	}
+	if len(r.AllowRoutines) > 0 && !matchAny(r.AllowRoutines, routine) {
+		return false
+	}
+	return !matchAnyFold(r.DenyRoutines, routine)
+}
+
+// columnHidden reports whether the column of table is hidden.
+func (r *accessRules) columnHidden(table, column string) bool {
+	if r == nil {
+		return false
+	}
+	for _, pattern := range r.DenyColumns {
+		if matchColumn(pattern, table, column) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchColumn reports whether a column or table.column pattern matches the column of table, ignoring case.
+// The table part may itself be qualified with a schema, as in billing.invoices.total.
+func matchColumn(pattern, table, column string) bool {
+	tablePattern, columnPattern := "*", pattern
+	if i := strings.LastIndex(pattern, "."); i >= 0 {
+		tablePattern, columnPattern = pattern[:i], pattern[i+1:]
+	}
+	return matchFold(tablePattern, table) && matchFold(columnPattern, column)
+}
+
+// operations returns the operations allowed on table, or nil when it is not restricted.
+// An exact table name takes precedence over patterns.
+func (r *accessRules) operations(table string) []string {
+	if r == nil {
+		return nil
+	}
+	if ops, ok := r.Permissions[table]; ok {
+		return ops
+	}
+	keys := make([]string, 0, len(r.Permissions))
+	for key := range r.Permissions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if matchFold(key, table) {
+			return r.Permissions[key]
+		}
+	}
+	return nil
+}
+
+// checkTable rejects requests to hidden tables and operations that are not allowed on table.
+// Hidden tables are reported as missing so that their existence is not revealed.
+func (r *accessRules) checkTable(table, operation string) error {
+	if !validName(table) || !r.tableVisible(table) {
+		return newDBError(errNotFound, fmt.Errorf("table %s not found", table))
+	}
+	if ops := r.operations(table); ops != nil && !slices.Contains(ops, operation) {
+		return newDBError(errPermissionDenied, fmt.Errorf("%s is not allowed on table %s", operation, table))
+	}
+	return nil
+}
+
+// policies returns the row policies of table that apply to operation and to the caller.
+// Policies are collected from every matching table pattern.
+func (r *accessRules) policies(table, operation string, ctx map[string]any) []rowPolicy {
+	if r == nil {
+		return nil
+	}
+	var result []rowPolicy
+	for pattern, policies := range r.Policies {
+		if !matchFold(pattern, table) {
+			continue
+		}
+		for _, policy := range policies {
+			if !slices.Contains(policy.Operations, operation) {
+				continue
+			}
+			if policy.BypassRole != "" && hasClaimValue(ctx, policy.BypassClaim, policy.BypassRole) {
+				continue
+			}
+			result = append(result, policy)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Column < result[j].Column })
+	return result
+}
+
+// contextValue resolves a flattened context key such as claims_sub, or an erctx.<key> or request.<path>
+// reference, against the context flattened by easyrest.FormatToContext.
+func contextValue(flatCtx map[string]string, ref string) (string, bool) {
+	key := ref
+	if prefix, rest, ok := strings.Cut(ref, "."); ok && (prefix == "erctx" || prefix == "request") {
+		key = rest
+	}
+	val, ok := flatCtx[strings.ToLower(strings.ReplaceAll(key, ".", "_"))]
+	return val, ok && val != ""
+}
+
+// policyValue resolves the context value of policy.
+// Missing values deny access: a policy never falls back to matching every row.
+func policyValue(table string, policy rowPolicy, flatCtx map[string]string) (string, error) {
+	val, ok := contextValue(flatCtx, policy.Value)
+	if !ok {
+		return "", newDBError(errPermissionDenied, fmt.Errorf("row policy of table %s requires %s in the request context", table, policy.Value))
+	}
+	return val, nil
+}
+
+// policyCondition returns the condition and arguments that restrict the rows of table for operation,
+// or an empty condition when no policy applies. A non-empty alias qualifies the policy columns.
+func (r *accessRules) policyCondition(table, alias, operation string, ctx map[string]any) (string, []any, error) {
+	policies := r.policies(table, operation, ctx)
+	if len(policies) == 0 {
+		return "", nil, nil
+	}
+	flatCtx, err := easyrest.FormatToContext(ctx)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to format context: %w", err)
+	}
+	var conds []string
+	var args []any
+	for _, policy := range policies {
+		val, err := policyValue(table, policy, flatCtx)
+		if err != nil {
+			return "", nil, err
+		}
+		column := policy.Column
+		if alias != "" {
+			column = alias + "." + column
+		}
+		conds = append(conds, column+" = ?")
+		args = append(args, val)
+	}
+	return strings.Join(conds, " AND "), args, nil
+}
+
+// auditColumns returns the audit columns of table set by operation, from every matching table pattern.
+func (r *accessRules) auditColumns(table, operation string) []auditColumn {
+	if r == nil {
+		return nil
+	}
+	var result []auditColumn
+	for pattern, columns := range r.AuditColumns {
+		if !matchFold(pattern, table) {
+			continue
+		}
+		for _, col := range columns {
+			if slices.Contains(col.Operations, operation) {
+				result = append(result, col)
+			}
+		}
+	}
+	return result
+}
+
+// isAuditColumn reports whether the column of table is set by the plugin on insert or update.
+func (r *accessRules) isAuditColumn(table, column string) bool {
+	for _, op := range []string{opInsert, opUpdate} {
+		for _, col := range r.auditColumns(table, op) {
+			if strings.EqualFold(col.Column, column) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// applyAuditColumns returns copies of rows with the audit columns of table for operation
+// set from the request context. A missing context value rejects the request.
+func (r *accessRules) applyAuditColumns(table, operation string, ctx map[string]any, rows []map[string]any) ([]map[string]any, error) {
+	columns := r.auditColumns(table, operation)
+	if len(columns) == 0 {
+		return rows, nil
+	}
+	flatCtx, err := easyrest.FormatToContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to format context: %w", err)
+	}
+	values := make(map[string]string, len(columns))
+	for _, col := range columns {
+		val, ok := contextValue(flatCtx, col.Value)
+		if !ok {
+			return nil, newDBError(errPermissionDenied, fmt.Errorf("audit column %s of table %s requires %s in the request context", col.Column, table, col.Value))
+		}
+		values[col.Column] = val
+	}
+	result := make([]map[string]any, len(rows))
+	for i, row := range rows {
+		result[i] = maps.Clone(row)
+		if result[i] == nil {
+			result[i] = make(map[string]any, len(values))
+		}
+		for column, val := range values {
+			// Drop client spellings of the column in another case, which would be written too.
+			maps.DeleteFunc(result[i], func(key string, _ any) bool { return strings.EqualFold(key, column) })
+			result[i][column] = val
+		}
+	}
+	return result, nil
+}
+
+// checkPolicyRows rejects rows that would be outside the policies of table after operation,
+// like a CHECK constraint: every policy column must be present and equal to its context value.
+// For updates only the policy columns present in the row are checked.
+func (r *accessRules) checkPolicyRows(table, operation string, ctx map[string]any, rows ...map[string]any) error {
+	policies := r.policies(table, operation, ctx)
+	if len(policies) == 0 {
+		return nil
+	}
+	flatCtx, err := easyrest.FormatToContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to format context: %w", err)
+	}
+	for _, policy := range policies {
+		want, err := policyValue(table, policy, flatCtx)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			// Column names are case-insensitive, so every spelling of the policy column is checked.
+			found := false
+			for column, val := range row {
+				if !strings.EqualFold(column, policy.Column) {
+					continue
+				}
+				found = true
+				if val == nil || fmt.Sprint(val) != want {
+					return newDBError(errPermissionDenied, fmt.Errorf("row violates the policy of table %s on %s", table, policy.Column))
+				}
+			}
+			if !found && operation != opUpdate {
+				return newDBError(errPermissionDenied, fmt.Errorf("row violates the policy of table %s on %s", table, policy.Column))
+			}
+		}
+	}
+	return nil
+}
+
+var (
+	reQuotedString = regexp.MustCompile(`'(?:[^'\\]|\\.)*'`)
+	reIdentifier   = regexp.MustCompile("[A-Za-z_][A-Za-z0-9_$]*")
+	// reIdentifierQuote matches the quotes of quoted identifiers: backticks, and double quotes under ANSI_QUOTES.
+	reIdentifierQuote = regexp.MustCompile("[`\"]")
+)
+
+// checkColumns rejects expressions (selected fields, filters, ordering, grouping or written columns)
+// that reference a hidden column of table. Like unknown columns in MySQL, they are reported as validation errors.
+func (r *accessRules) checkColumns(table string, exprs ...string) error {
+	if r == nil || len(r.DenyColumns) == 0 {
+		return nil
+	}
+	for _, expr := range exprs {
+		for _, name := range identifiers(expr) {
+			if r.columnHidden(table, name) {
+				return newDBError(errValidation, fmt.Errorf("unknown column %s", name))
+			}
+		}
+	}
+	return nil
+}
+
+// identifiers returns the identifiers referenced by a SQL expression, ignoring string literals.
+// Double-quoted text is taken as an identifier, as it is under sqlMode=ANSI_QUOTES.
+func identifiers(expr string) []string {
+	expr = reQuotedString.ReplaceAllString(reIdentifierQuote.ReplaceAllString(expr, ""), "")
+	return reIdentifier.FindAllString(expr, -1)
+}
+
+// validName reports whether name is a plain table or routine name, optionally qualified with a schema.
+// Quoted names are rejected so that access rules always see the name MySQL resolves.
+func validName(name string) bool {
+	parts := strings.Split(name, ".")
+	if len(parts) > 2 {
+		return false
+	}
+	for _, part := range parts {
+		if !reSchemaName.MatchString(part) {
+			return false
+		}
+	}
+	return true
+}
+
+// stripColumns removes hidden columns of table from result rows, e.g. those selected with *.
+func (r *accessRules) stripColumns(table string, rows []map[string]any) {
+	if r == nil || len(r.DenyColumns) == 0 {
+		return
+	}
+	for _, row := range rows {
+		for column := range row {
+			if r.columnHidden(table, column) {
+				delete(row, column)
+			}
+		}
+	}
+}
+
+// mask returns the mask applied to the column of table for the caller, if any.
+// The first matching mask wins.
+func (r *accessRules) mask(table, column string, ctx map[string]any) (columnMask, bool) {
+	if r == nil {
+		return columnMask{}, false
+	}
+	for _, mask := range r.Masks {
+		if !matchColumn(mask.Column, table, column) {
+			continue
+		}
+		for _, role := range mask.UnmaskRoles {
+			if hasClaimValue(ctx, mask.Claim, role) {
+				return columnMask{}, false
+			}
+		}
+		return mask, true
+	}
+	return columnMask{}, false
+}
+
+// checkMasked rejects filters, ordering and grouping that reference a column masked for the caller:
+// comparing or sorting by it would reveal the value one guess at a time. Selected fields may name
+// a masked column directly, since its values are masked in the result, but not use it in an expression
+// whose result would escape the mask.
+func (r *accessRules) checkMasked(table string, ctx map[string]any, selectFields []string, exprs ...string) error {
+	if r == nil || len(r.Masks) == 0 {
+		return nil
+	}
+	for _, field := range selectFields {
+		name := strings.TrimSpace(reIdentifierQuote.ReplaceAllString(field, ""))
+		if i := strings.LastIndex(name, "."); i >= 0 && strings.EqualFold(name[:i], table) {
+			name = name[i+1:]
+		}
+		if reColumnName.MatchString(name) {
+			continue
+		}
+		exprs = append(exprs, field)
+	}
+	for _, expr := range exprs {
+		for _, name := range identifiers(expr) {
+			if _, masked := r.mask(table, name, ctx); masked {
+				return newDBError(errPermissionDenied, fmt.Errorf("column %s is masked and cannot be used in %s", name, expr))
+			}
+		}
+	}
+	return nil
+}
+
+// maskRows masks the values of columns masked for the caller in result rows of table.
+// Columns are matched whatever case the query returned them in.
+func (r *accessRules) maskRows(table string, ctx map[string]any, rows []map[string]any) {
+	if r == nil || len(r.Masks) == 0 || len(rows) == 0 {
+		return
+	}
+	type lookup struct {
+		mask   columnMask
+		masked bool
+	}
+	masks := make(map[string]lookup)
+	for _, row := range rows {
+		for column, v := range row {
+			l, ok := masks[column]
+			if !ok {
+				l.mask, l.masked = r.mask(table, column, ctx)
+				masks[column] = l
+			}
+			if l.masked {
+				row[column] = maskValue(l.mask.Mode, r.maskKey, v)
+			}
+		}
+	}
+}
+
+// maskValue masks a single value; null stays null. key is the HMAC key of the hash mode.
+func maskValue(mode string, key []byte, v any) any {
+	if v == nil || mode == maskNull {
+		return nil
+	}
+	s := fmt.Sprint(v)
+	if b, ok := v.([]byte); ok {
+		s = string(b)
+	}
+	if mode == maskHash {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(s))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	if local, domain, ok := strings.Cut(s, "@"); ok && local != "" {
+		first := []rune(local)[0]
+		return string(first) + strings.Repeat("*", utf8.RuneCountInString(local)-1) + "@" + domain
+	}
+	runes := []rune(s)
+	keep := 4
+	if len(runes) <= keep*2 {
+		keep = len(runes) / 4
+	}
+	return strings.Repeat("*", len(runes)-keep) + string(runes[len(runes)-keep:])
+}
+
+// keysOf returns the keys of m.
+func keysOf(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// auditLog writes a record of every row changed by TableCreate, TableUpdate and TableDelete to the table
+// named by auditTable, in the transaction of the change. All methods are no-ops on a nil *auditLog.
+type auditLog struct {
+	table  string
+	claims []string // claims copied into each record
+}
+
+// auditEntry is the image of one changed row; Before is nil for inserts and After is nil for deletes.
+type auditEntry struct {
+	Before map[string]any
+	After  map[string]any
+}
+
+// newAuditLog creates the audit log from the auditTable and auditClaims URI parameters,
+// removing them from params. It returns nil when auditTable is not set.
+func newAuditLog(params url.Values) (*auditLog, error) {
+	table, claims := params.Get("auditTable"), params.Get("auditClaims")
+	params.Del("auditTable")
+	params.Del("auditClaims")
+	if table == "" {
+		return nil, nil
+	}
+	if !reColumnName.MatchString(table) {
+		return nil, fmt.Errorf("invalid auditTable value: %s", table)
+	}
+	a := &auditLog{table: table, claims: []string{"sub"}}
+	if claims != "" {
+		a.claims = nil
+		for _, claim := range strings.Split(claims, ",") {
+			if claim = strings.TrimSpace(claim); claim != "" {
+				a.claims = append(a.claims, claim)
+			}
+		}
+	}
+	return a, nil
+}
+
+// createTable creates the audit table if it does not exist.
+func (a *auditLog) createTable(ctx context.Context, db *sql.DB) error {
+	if a == nil {
+		return nil
+	}
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	id BIGINT AUTO_INCREMENT PRIMARY KEY,
+	created_at TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+	user_id VARCHAR(255) NOT NULL,
+	operation VARCHAR(16) NOT NULL,
+	table_name VARCHAR(64) NOT NULL,
+	claims JSON NULL,
+	before_image JSON NULL,
+	after_image JSON NULL,
+	KEY idx_table_created (table_name, created_at)
+)`, a.table))
+	if err != nil {
+		return fmt.Errorf("failed to create audit table: %w", err)
+	}
+	return nil
+}
+
+// snapshot locks and returns the rows of table matching whereClause, before they are changed.
+func (a *auditLog) snapshot(ctx context.Context, tx *sql.Tx, table, whereClause string, args []any) ([]map[string]any, error) {
+	if a == nil {
+		return nil, nil
+	}
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT * FROM %s%s FOR UPDATE", table, whereClause), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rows for audit: %w", err)
+	}
+	defer rows.Close()
+	return scanRows(rows)
+}
+
+// write inserts one audit record per entry.
+func (a *auditLog) write(ctx context.Context, tx *sql.Tx, userID, operation, table string, ctxMap map[string]any, entries []auditEntry) error {
+	if a == nil || len(entries) == 0 {
+		return nil
+	}
+	claims := make(map[string]any)
+	if all, ok := ctxMap["claims"].(map[string]any); ok {
+		for _, name := range a.claims {
+			if val, ok := all[name]; ok {
+				claims[name] = val
+			}
+		}
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit claims: %w", err)
+	}
+	var values []string
+	var args []any
+	for _, entry := range entries {
+		before, err := marshalImage(entry.Before)
+		if err != nil {
+			return err
+		}
+		after, err := marshalImage(entry.After)
+		if err != nil {
+			return err
+		}
+		values = append(values, "(?, ?, ?, ?, ?, ?)")
+		args = append(args, userID, operation, table, string(claimsJSON), before, after)
+	}
+	query := fmt.Sprintf("INSERT INTO %s (user_id, operation, table_name, claims, before_image, after_image) VALUES %s", a.table, strings.Join(values, ", "))
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return nil
+}
+
+// marshalImage encodes a row image as JSON; a nil image is stored as NULL.
+func marshalImage(row map[string]any) (any, error) {
+	if row == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(row)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode audit image: %w", err)
+	}
+	return string(data), nil
+}
+
+// auditKey is the primary key of an audited table, used to read rows back after they are written.
+type auditKey struct {
+	columns       []string
+	types         []string // DATA_TYPE of each column
+	autoIncrement string   // column filled by LAST_INSERT_ID(), if any
+}
+
+// primaryKey looks up the primary key of table in schema (the current database when empty).
+// A table without one has no columns: its after images are built from the request data.
+func (a *auditLog) primaryKey(ctx context.Context, tx *sql.Tx, schema, table string) (auditKey, error) {
+	var key auditKey
+	if a == nil {
+		return key, nil
+	}
+	cond, args := schemaCondition(schema)
+	rows, err := tx.QueryContext(ctx, `
+SELECT COLUMN_NAME, DATA_TYPE, EXTRA
+FROM INFORMATION_SCHEMA.COLUMNS
+WHERE TABLE_SCHEMA = `+cond+` AND TABLE_NAME = ? AND COLUMN_KEY = 'PRI'
+ORDER BY ORDINAL_POSITION
+`, append(args, table)...)
+	if err != nil {
+		return key, fmt.Errorf("failed to read primary key for audit: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var column, dataType, extra string
+		if err := rows.Scan(&column, &dataType, &extra); err != nil {
+			return key, err
+		}
+		key.columns = append(key.columns, column)
+		key.types = append(key.types, strings.ToLower(dataType))
+		if strings.Contains(strings.ToLower(extra), "auto_increment") {
+			key.autoIncrement = column
+		}
+	}
+	return key, rows.Err()
+}
+
+// reread returns the row of the table ref whose primary key has values, as stored after a write,
+// or nil when there is no such row.
+func (a *auditLog) reread(ctx context.Context, tx *sql.Tx, ref string, key auditKey, values []any) (map[string]any, error) {
+	conds := make([]string, len(key.columns))
+	for i, column := range key.columns {
+		conds[i] = quoteIdentifier(column) + " = ?"
+	}
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT * FROM %s WHERE %s", ref, strings.Join(conds, " AND ")), values...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rows for audit: %w", err)
+	}
+	defer rows.Close()
+	images, err := scanRows(rows)
+	if err != nil || len(images) == 0 {
+		return nil, err
+	}
+	return images[0], nil
+}
+
+// insertedImage returns the after image of row, inserted into the table ref with the LAST_INSERT_ID() id.
+// It falls back to row when the primary key is unknown.
+func (a *auditLog) insertedImage(ctx context.Context, tx *sql.Tx, ref string, key auditKey, row map[string]any, id int64) (map[string]any, error) {
+	if len(key.columns) == 0 {
+		return row, nil
+	}
+	values := make([]any, len(key.columns))
+	for i, column := range key.columns {
+		v, ok := lookupFold(row, column)
+		if (!ok || v == nil) && column == key.autoIncrement {
+			v, ok = id, true
+		}
+		if !ok {
+			// The key comes from a default expression, which cannot be read back.
+			return row, nil
+		}
+		values[i] = v
+	}
+	image, err := a.reread(ctx, tx, ref, key, values)
+	if err != nil || image == nil {
+		return row, err
+	}
+	return image, nil
+}
+
+// updatedImages returns the before and after images of the rows of the table ref changed by an
+// UPDATE setting data, reading each row back by its primary key so that changes made by the server
+// (ON UPDATE columns, triggers) are recorded. Without a primary key, data is merged into the before images.
+func (a *auditLog) updatedImages(ctx context.Context, tx *sql.Tx, ref string, key auditKey, before []map[string]any, data map[string]any) ([]auditEntry, error) {
+	entries := make([]auditEntry, 0, len(before))
+	for _, row := range before {
+		after := maps.Clone(row)
+		maps.Copy(after, data)
+		if len(key.columns) > 0 {
+			values := make([]any, len(key.columns))
+			for i, column := range key.columns {
+				// A key changed by the update is looked up with its new value.
+				if v, ok := lookupFold(data, column); ok {
+					values[i] = v
+				} else {
+					values[i] = keyValue(row[column], key.types[i])
+				}
+			}
+			image, err := a.reread(ctx, tx, ref, key, values)
+			if err != nil {
+				return nil, err
+			}
+			if image != nil {
+				after = image
+			}
+		}
+		entries = append(entries, auditEntry{Before: row, After: after})
+	}
+	return entries, nil
+}
+
+// lookupFold returns the value of column in row, whatever case its key is in.
+func lookupFold(row map[string]any, column string) (any, bool) {
+	if v, ok := row[column]; ok {
+		return v, true
+	}
+	for k, v := range row {
+		if strings.EqualFold(k, column) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// keyValue turns a key value as returned by scanRows back into a query argument:
+// binary values are base64-decoded and date-times parsed.
+func keyValue(v any, dataType string) any {
+	text, ok := v.(string)
+	if !ok {
+		return v
+	}
+	switch dataType {
+	case "binary", "varbinary":
+		if b, err := base64.StdEncoding.DecodeString(text); err == nil {
+			return b
+		}
+	case "datetime", "timestamp":
+		if t, err := time.Parse(time.RFC3339Nano, text); err == nil {
+			return t
+		}
+	}
+	return v
+}
+
+// systemSchemas are never used as tenant schemas, whatever tenantSchemas allows.
+var systemSchemas = []string{"mysql", "information_schema", "performance_schema", "sys"}
+
+var reSchemaName = regexp.MustCompile(`^[A-Za-z0-9_$]{1,64}$`)
+
+// tenantRouting runs each request in the schema named by a value of its context,
+// e.g. the claims_tenant value selects the schema tenant_acme with the prefix tenant_.
+type tenantRouting struct {
+	key     string   // context key, as accepted by contextValue
+	prefix  string   // prepended to the context value to form the schema name
+	schemas []string // patterns the schema name must match
+	ttl     time.Duration
+
+	mu    sync.Mutex // guards cache
+	cache map[string]*schemaMeta
+}
+
+// schemaMeta caches the metadata of a tenant schema. Its own lock is held while the metadata is
+// loaded, so that loading one schema neither blocks requests of other tenants nor runs twice.
+type schemaMeta struct {
+	mu         sync.Mutex
+	routines   map[string]RoutineInfo
+	routinesAt time.Time
+	tables     map[string]any // GetSchema tables
+	tablesAt   time.Time
+}
+
+// newTenantRouting creates the tenant routing from the tenantClaim, tenantSchemas, tenantSchemaPrefix and
+// tenantCacheTTL URI parameters, removing them from params. It returns nil when tenantClaim is not set.
+func newTenantRouting(params url.Values) (*tenantRouting, error) {
+	key, schemas, prefix, ttl := params.Get("tenantClaim"), params.Get("tenantSchemas"), params.Get("tenantSchemaPrefix"), params.Get("tenantCacheTTL")
+	params.Del("tenantClaim")
+	params.Del("tenantSchemas")
+	params.Del("tenantSchemaPrefix")
+	params.Del("tenantCacheTTL")
+	if key == "" {
+		return nil, nil
+	}
+	t := &tenantRouting{key: key, prefix: prefix, ttl: 300 * time.Second, cache: make(map[string]*schemaMeta)}
+	for _, pattern := range strings.Split(schemas, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid tenantSchemas pattern %q: %w", pattern, err)
+		}
+		t.schemas = append(t.schemas, pattern)
+	}
+	if len(t.schemas) == 0 {
+		return nil, errors.New("tenantSchemas is required with tenantClaim")
+	}
+	if ttl != "" {
+		seconds, err := strconv.Atoi(ttl)
+		if err != nil || seconds < 0 {
+			return nil, fmt.Errorf("invalid tenantCacheTTL value: %s", ttl)
+		}
+		t.ttl = time.Duration(seconds) * time.Second
+	}
+	return t, nil
+}
+
+// lookup returns the tenant schema of the request. found is false when the context has no tenant value.
+func (t *tenantRouting) lookup(ctx map[string]any) (schema string, found bool, err error) {
+	flatCtx, err := easyrest.FormatToContext(ctx)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to format context: %w", err)
+	}
+	val, ok := contextValue(flatCtx, t.key)
+	if !ok {
+		return "", false, nil
+	}
+	schema = t.prefix + val
+	if !reSchemaName.MatchString(schema) || slices.Contains(systemSchemas, strings.ToLower(schema)) || !matchAny(t.schemas, schema) {
+		return "", true, newDBError(errPermissionDenied, fmt.Errorf("tenant schema %s is not allowed", schema))
+	}
+	return schema, true, nil
+}
+
+// requestSchema returns the schema a request runs in: empty for the database of the DSN, or the tenant schema.
+// With tenant routing, requests without a tenant are rejected.
+func (m *mysqlPlugin) requestSchema(ctx map[string]any) (string, error) {
+	if m.tenants == nil {
+		return "", nil
+	}
+	schema, found, err := m.tenants.lookup(ctx)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", newDBError(errPermissionDenied, fmt.Errorf("request context has no tenant (%s)", m.tenants.key))
+	}
+	return schema, nil
+}
+
+// parseSchemas parses the schemas URI parameter, a comma-separated list of schemas whose tables
+// and routines are exposed as schema.name next to those of the database of the DSN.
+func parseSchemas(value string) ([]string, error) {
+	var schemas []string
+	for _, schema := range strings.Split(value, ",") {
+		if schema = strings.TrimSpace(schema); schema == "" {
+			continue
+		}
+		if !reSchemaName.MatchString(schema) || slices.Contains(systemSchemas, strings.ToLower(schema)) {
+			return nil, fmt.Errorf("invalid schemas value: %s", schema)
+		}
+		if !slices.Contains(schemas, schema) {
+			schemas = append(schemas, schema)
+		}
+	}
+	return schemas, nil
+}
+
+// resolve splits the exposed name of a table or routine into the schema it lives in and its name there.
+// A name qualified with one of the listed schemas selects that schema; other names run in requestSchema.
+func (m *mysqlPlugin) resolve(ctx map[string]any, name, kind string) (schema, object string, err error) {
+	if !validName(name) {
+		return "", "", newDBError(errNotFound, fmt.Errorf("%s %s not found", kind, name))
+	}
+	if prefix, rest, ok := strings.Cut(name, "."); ok {
+		if !slices.Contains(m.schemas, prefix) {
+			return "", "", newDBError(errNotFound, fmt.Errorf("%s %s not found", kind, name))
+		}
+		return prefix, rest, nil
+	}
+	schema, err = m.requestSchema(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	return schema, name, nil
+}
+
+// meta returns the cache entry of schema.
+func (t *tenantRouting) meta(schema string) *schemaMeta {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	meta, ok := t.cache[schema]
+	if !ok {
+		meta = &schemaMeta{}
+		t.cache[schema] = meta
+	}
+	return meta
+}
+
+// routinesFor returns the routines of schema, cached for tenantCacheTTL for tenant schemas.
+func (m *mysqlPlugin) routinesFor(schema string) (map[string]RoutineInfo, error) {
+	if schema == "" {
+		return m.routines, nil
+	}
+	if routines, ok := m.schemaRoutines[schema]; ok {
+		return routines, nil
+	}
+	meta := m.tenants.meta(schema)
+	meta.mu.Lock()
+	defer meta.mu.Unlock()
+	if meta.routines == nil || time.Since(meta.routinesAt) >= m.tenants.ttl {
+		routines, err := m.queryRoutines(schema)
+		if err != nil {
+			return nil, err
+		}
+		meta.routines, meta.routinesAt = routines, time.Now()
+	}
+	return meta.routines, nil
+}
+
+// tablesFor returns the GetSchema tables of schema, cached for tenantCacheTTL for tenant schemas.
+func (m *mysqlPlugin) tablesFor(db *sql.DB, schema string) (map[string]any, error) {
+	if schema == "" {
+		return m.getTablesSchema(db, schema, "")
+	}
+	meta := m.tenants.meta(schema)
+	meta.mu.Lock()
+	defer meta.mu.Unlock()
+	if meta.tables == nil || time.Since(meta.tablesAt) >= m.tenants.ttl {
+		tables, err := m.getTablesSchema(db, schema, "")
+		if err != nil {
+			return nil, err
+		}
+		meta.tables, meta.tablesAt = tables, time.Now()
+	}
+	return meta.tables, nil
+}
+
+// Error kinds reported by the plugin. EasyREST maps them to HTTP status codes.
+const (
+	errNotFound            = "not_found"
+	errConflict            = "conflict"
+	errConstraintViolation = "constraint_violation"
+	errPermissionDenied    = "permission_denied"
+	errValidation          = "validation"
+	errTimeout             = "timeout"
+	errUnavailable         = "unavailable"
+	errQueryPlan           = "query_plan"
+)
+
+// errKindStatus maps error kinds to HTTP status codes.
+var errKindStatus = map[string]int{
+	errNotFound:            404,
+	errConflict:            409,
+	errConstraintViolation: 409,
+	errPermissionDenied:    403,
+	errValidation:          400,
+	errTimeout:             504,
+	errUnavailable:         503,
+	errQueryPlan:           422,
+}
+
+// mysqlErrorKinds classifies MySQL server error numbers.
+var mysqlErrorKinds = map[uint16]string{
+	1049: errNotFound,            // Unknown database
+	1146: errNotFound,            // Table doesn't exist
+	1305: errNotFound,            // Routine doesn't exist
+	1062: errConflict,            // Duplicate entry
+	1586: errConflict,            // Duplicate entry for key
+	1213: errConflict,            // Deadlock
+	1048: errConstraintViolation, // Column cannot be null
+	1451: errConstraintViolation, // Cannot delete or update a parent row
+	1452: errConstraintViolation, // Cannot add or update a child row
+	3819: errConstraintViolation, // Check constraint is violated
+	1044: errPermissionDenied,    // Access denied for user to database
+	1045: errPermissionDenied,    // Access denied for user
+	1142: errPermissionDenied,    // Command denied to user for table
+	1143: errPermissionDenied,    // Command denied to user for column
+	1227: errPermissionDenied,    // Missing privilege
+	1370: errPermissionDenied,    // Command denied to user for routine
+	1054: errValidation,          // Unknown column
+	1064: errValidation,          // Syntax error
+	1264: errValidation,          // Out of range value
+	1292: errValidation,          // Incorrect value
+	1318: errValidation,          // Incorrect number of arguments
+	1364: errValidation,          // Field doesn't have a default value
+	1366: errValidation,          // Incorrect value for column
+	1406: errValidation,          // Data too long for column
+	3140: errValidation,          // Invalid JSON text
+	1205: errTimeout,             // Lock wait timeout exceeded
+	3024: errTimeout,             // Maximum statement execution time exceeded
+	1969: errTimeout,             // Query execution was interrupted (MariaDB max_statement_time)
+	1040: errUnavailable,         // Too many connections
+	1053: errUnavailable,         // Server shutdown in progress
+	1290: errUnavailable,         // Server is running with --read-only
+	1836: errUnavailable,         // Running in read-only mode
+}
+
+var (
+	reErrKey        = regexp.MustCompile(`for key '([^']+)'`)
+	reErrConstraint = regexp.MustCompile("(?i)constraint [`']([^`']+)[`']")
+	reErrForeignKey = regexp.MustCompile("FOREIGN KEY \\(`([^`]+)`")
+	reErrColumn     = regexp.MustCompile(`(?i)(?:column|field) '([^']+)'`)
+)
+
+// dbError is a classified plugin error. Its text has the stable format
+// "<kind>: <message> [status=<http status> code=<mysql error> sqlstate=<state> constraint=<name> column=<name>]",
+// where code, sqlstate, constraint and column are only present when known.
+type dbError struct {
+	Kind       string
+	Code       uint16
+	SQLState   string
+	Constraint string
+	Column     string
+	Err        error
+}
+
+// newDBError wraps err with the given kind.
+func newDBError(kind string, err error) *dbError {
+	return &dbError{Kind: kind, Err: err}
+}
+
+func (e *dbError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.Kind)
+	b.WriteString(": ")
+	b.WriteString(e.Err.Error())
+	b.WriteString(" [status=")
+	b.WriteString(strconv.Itoa(e.HTTPStatus()))
+	if e.Code != 0 {
+		b.WriteString(" code=")
+		b.WriteString(strconv.Itoa(int(e.Code)))
+	}
+	if e.SQLState != "" {
+		b.WriteString(" sqlstate=")
+		b.WriteString(e.SQLState)
+	}
+	if e.Constraint != "" {
+		b.WriteString(" constraint=")
+		b.WriteString(e.Constraint)
+	}
+	if e.Column != "" {
+		b.WriteString(" column=")
+		b.WriteString(e.Column)
+	}
+	b.WriteByte(']')
+	return b.String()
+}
+
+func (e *dbError) Unwrap() error {
+	return e.Err
+}
+
+// HTTPStatus returns the HTTP status code matching the error kind.
+func (e *dbError) HTTPStatus() int {
+	if status, ok := errKindStatus[e.Kind]; ok {
+		return status
+	}
+	return 500
+}
+
+// classifyError converts MySQL and driver errors into a *dbError.
+// Errors that cannot be classified are returned unchanged.
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var dbErr *dbError
+	if errors.As(err, &dbErr) {
+		return err
+	}
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		kind, ok := mysqlErrorKinds[mysqlErr.Number]
+		if !ok {
+			kind = sqlStateKind(string(mysqlErr.SQLState[:]))
+		}
+		if kind == "" {
+			return err
+		}
+		dbErr = &dbError{Kind: kind, Code: mysqlErr.Number, Err: err}
+		if mysqlErr.SQLState != [5]byte{} {
+			dbErr.SQLState = string(mysqlErr.SQLState[:])
+		}
+		if match := reErrKey.FindStringSubmatch(mysqlErr.Message); match != nil {
+			dbErr.Constraint = match[1]
+		} else if match := reErrConstraint.FindStringSubmatch(mysqlErr.Message); match != nil {
+			dbErr.Constraint = match[1]
+		}
+		if match := reErrForeignKey.FindStringSubmatch(mysqlErr.Message); match != nil {
+			dbErr.Column = match[1]
+		} else if match := reErrColumn.FindStringSubmatch(mysqlErr.Message); match != nil {
+			dbErr.Column = match[1]
+		}
+		return dbErr
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return newDBError(errTimeout, err)
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) {
+		return newDBError(errUnavailable, err)
+	}
+	return err
+}
+
+// sqlStateKind classifies errors by SQLSTATE when the MySQL error number is not known.
+// SQLSTATE 45000 is what SIGNAL raises from triggers and routines to reject a request.
+func sqlStateKind(state string) string {
+	switch {
+	case state == "45000":
+		return errPermissionDenied
+	case strings.HasPrefix(state, "23"):
+		return errConstraintViolation
+	case strings.HasPrefix(state, "22"):
+		return errValidation
+	case strings.HasPrefix(state, "42"):
+		return errValidation
+	case strings.HasPrefix(state, "08"):
+		return errUnavailable
+	}
+	return ""
+}
+
+// scanRows converts row data into []map[string]any.
+// Pre-allocates memory for results with a capacity of 100 for better performance.
+func scanRows(r rowScanner) ([]map[string]any, error) {
+	cols, err := r.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get columns: %w", err)
+	}
+	numCols := len(cols)
+	results := make([]map[string]any, 0, 100) // Pre-allocate memory for results
+	columns := make([]any, numCols)
+	pointers := make([]any, numCols)
+	for i := range columns {
+		pointers[i] = &columns[i]
+	}
+	// Database type names, such as DATETIME or BLOB; empty when the driver does not report them.
+	typeNames := make([]string, numCols)
+	if typer, ok := r.(columnTyper); ok {
+		if types, err := typer.ColumnTypes(); err == nil {
+			for i, ct := range types {
+				typeNames[i] = ct.DatabaseTypeName()
+			}
+		}
+	}
+
+	for r.Next() {
+		if err := r.Scan(pointers...); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		rowMap := make(map[string]any, numCols)
+		for i, colName := range cols {
+			switch val := columns[i].(type) {
+			case time.Time:
+				rowMap[colName] = formatTime(val, typeNames[i])
+			case []byte:
+				rowMap[colName] = decodeBytes(val, typeNames[i])
+			default:
+				rowMap[colName] = val
+			}
+		}
+		results = append(results, rowMap)
+	}
+	if err := r.Err(); err != nil {
+		return nil, fmt.Errorf("row iteration error: %w", err)
+	}
+	return results, nil
+}
+
+// formatTime formats a DATE as 2006-01-02 and a DATETIME or TIMESTAMP as RFC 3339.
+// Without a type name, values at midnight are taken to be dates.
+func formatTime(t time.Time, typeName string) string {
+	switch typeName {
+	case "DATE":
+		return t.Format(time.DateOnly)
+	case "":
+		if t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 && t.Nanosecond() == 0 {
+			return t.Format(time.DateOnly)
+		}
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// dateTimeLayout is the text form of DATETIME and TIMESTAMP values, with optional fractional seconds.
+const dateTimeLayout = "2006-01-02 15:04:05.999999999"
+
+// decodeBytes converts a value the driver returned as bytes according to its column type, which is
+// prefixed with UNSIGNED for unsigned integers. BIT values are big-endian integers, integers and
+// floating-point numbers are parsed, DATETIME and TIMESTAMP values are formatted as RFC 3339 (in UTC,
+// the driver's default loc, since text values carry no time zone), JSON documents are decoded and
+// binary strings are base64-encoded. DECIMAL values stay text so that no digit is lost. Text holding
+// a JSON object or array is decoded too, because MariaDB stores JSON columns as LONGTEXT.
+// Without a type name, values that parse as JSON are decoded and the others are returned as text.
+func decodeBytes(b []byte, typeName string) any {
+	switch strings.TrimPrefix(typeName, "UNSIGNED ") {
+	case "BIT":
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n
+	case "BINARY", "VARBINARY", "TINYBLOB", "BLOB", "MEDIUMBLOB", "LONGBLOB", "GEOMETRY", "VECTOR":
+		return base64.StdEncoding.EncodeToString(b)
+	case "TINYINT", "SMALLINT", "MEDIUMINT", "INT", "BIGINT", "YEAR":
+		if n, err := strconv.ParseInt(string(b), 10, 64); err == nil {
+			return n
+		}
+		if n, err := strconv.ParseUint(string(b), 10, 64); err == nil {
+			return n
+		}
+	case "FLOAT", "DOUBLE":
+		if f, err := strconv.ParseFloat(string(b), 64); err == nil {
+			return f
+		}
+	case "DATETIME", "TIMESTAMP":
+		// Zero dates do not parse and are returned as they are.
+		if t, err := time.ParseInLocation(dateTimeLayout, string(b), time.UTC); err == nil {
+			return t.Format(time.RFC3339Nano)
+		}
+	case "TEXT", "TINYTEXT", "MEDIUMTEXT", "LONGTEXT":
+		if trimmed := bytes.TrimSpace(b); len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '[') {
+			break
+		}
+		fallthrough
+	case "JSON", "":
+		var v any
+		if err := json.Unmarshal(b, &v); err == nil {
+			return v
+		}
+	}
+	return string(b)
+}
+
+// mysqlAddr is a server address of a mysql:// URI in go-sql-driver terms.
+type mysqlAddr struct {
+	Net  string // "tcp" or "unix"
+	Addr string // host:port or socket path
+}
+
+func (a mysqlAddr) String() string {
+	if a.Net == "unix" {
+		return "unix(" + a.Addr + ")"
+	}
+	return a.Addr
+}
+
+// mysqlURI is a parsed connection URI of the form
+//
+//	mysql://[user[:password]@]host[,host...][/database][?param=value&...]
+//
+// where each host is "name[:port]", "[ipv6][:port]", "tcp(name[:port])" or "unix(/path/to/socket)".
+// The user, password and database may be percent-encoded; the port defaults to 3306.
+type mysqlURI struct {
+	User     string
+	Password string
+	Hosts    []mysqlAddr
+	DBName   string
+	Params   url.Values
+}
+
+// parseMySQLURI parses uri. url.Parse is not used because it rejects or mangles
+// socket paths, unbracketed multi-host lists and IPv6 literals in host lists.
+func parseMySQLURI(uri string) (*mysqlURI, error) {
+	rest, ok := strings.CutPrefix(uri, "mysql://")
+	if !ok {
+		return nil, errors.New("invalid MySQL URI")
+	}
+	u := &mysqlURI{}
+	rest, _, _ = strings.Cut(rest, "#")
+	rest, rawQuery, _ := strings.Cut(rest, "?")
+	params, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query: %w", err)
+	}
+	u.Params = params
+
+	if i := strings.LastIndexByte(rest, '@'); i >= 0 {
+		user, password, _ := strings.Cut(rest[:i], ":")
+		if u.User, err = url.PathUnescape(user); err != nil {
+			return nil, fmt.Errorf("invalid user: %w", err)
+		}
+		if u.Password, err = url.PathUnescape(password); err != nil {
+			return nil, errors.New("invalid password encoding")
+		}
+		rest = rest[i+1:]
+	}
+
+	hosts, dbName := rest, ""
+	if i := indexOutside(rest, '/'); i >= 0 {
+		hosts, dbName = rest[:i], rest[i+1:]
+	}
+	if u.DBName, err = url.PathUnescape(dbName); err != nil {
+		return nil, fmt.Errorf("invalid database name: %w", err)
+	}
+	for hosts != "" {
+		host := hosts
+		if i := indexOutside(hosts, ','); i >= 0 {
+			host, hosts = hosts[:i], hosts[i+1:]
+		} else {
+			hosts = ""
+		}
+		addr, err := parseMySQLAddr(strings.TrimSpace(host))
+		if err != nil {
+			return nil, err
+		}
+		u.Hosts = append(u.Hosts, addr)
+	}
+	if len(u.Hosts) == 0 {
+		return nil, errors.New("missing host")
+	}
+	return u, nil
+}
+
+// indexOutside returns the index of the first c in s that is not inside parentheses or brackets, or -1.
+func indexOutside(s string, c byte) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '(', '[':
+			depth++
+		case ')', ']':
+			if depth > 0 {
+				depth--
+			}
+		case c:
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// parseMySQLAddr parses a single host of a mysql:// URI.
+func parseMySQLAddr(host string) (mysqlAddr, error) {
+	if path, ok := strings.CutPrefix(host, "unix("); ok {
+		path, ok = strings.CutSuffix(path, ")")
+		if !ok || path == "" {
+			return mysqlAddr{}, fmt.Errorf("invalid socket address: %s", host)
+		}
+		return mysqlAddr{Net: "unix", Addr: path}, nil
+	}
+	if inner, ok := strings.CutPrefix(host, "tcp("); ok {
+		if host, ok = strings.CutSuffix(inner, ")"); !ok {
+			return mysqlAddr{}, fmt.Errorf("invalid tcp address: tcp(%s", inner)
+		}
+	}
+
+	name, port := host, ""
+	if strings.HasPrefix(host, "[") {
+		end := strings.IndexByte(host, ']')
+		if end < 0 {
+			return mysqlAddr{}, fmt.Errorf("invalid IPv6 address: %s", host)
+		}
+		name = host[1:end]
+		if tail := host[end+1:]; tail != "" {
+			var ok bool
+			if port, ok = strings.CutPrefix(tail, ":"); !ok {
+				return mysqlAddr{}, fmt.Errorf("invalid IPv6 address: %s", host)
+			}
+		}
+	} else if strings.Count(host, ":") > 1 {
+		return mysqlAddr{}, fmt.Errorf("IPv6 address must be enclosed in brackets: %s", host)
+	} else if i := strings.IndexByte(host, ':'); i >= 0 {
+		name, port = host[:i], host[i+1:]
+	}
+	if name == "" {
+		return mysqlAddr{}, fmt.Errorf("missing host name: %s", host)
+	}
+	if port == "" {
+		port = "3306"
+	} else if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return mysqlAddr{}, fmt.Errorf("invalid port: %s", host)
+	}
+	return mysqlAddr{Net: "tcp", Addr: net.JoinHostPort(name, port)}, nil
+}
+
+// buildDSN formats the go-sql-driver DSN for addr from cfg, which holds the credentials,
+// database and driver parameters.
+func buildDSN(cfg *mysql.Config, addr mysqlAddr) string {
+	c := cfg.Clone()
+	c.Net, c.Addr = addr.Net, addr.Addr
+	return c.FormatDSN()
+}
+
+// reSessionName matches the character set, collation and variable names accepted in session settings.
+var reSessionName = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// parseSessionSettings builds the statements run on every new physical connection from the
+// charset, collation, sqlMode and sessionVars URI parameters, removing them from params.
+// sessionVars is a comma-separated list of name:value pairs.
+func parseSessionSettings(params url.Values) ([]string, error) {
+	charset, collation := params.Get("charset"), params.Get("collation")
+	sqlMode, sessionVars := params.Get("sqlMode"), params.Get("sessionVars")
+	setSQLMode := params.Has("sqlMode") // an empty sqlMode clears the server default
+	for _, name := range []string{"charset", "collation", "sqlMode", "sessionVars"} {
+		params.Del(name)
+	}
+	if charset == "" {
+		charset = "utf8mb4"
+		if collation == "" {
+			collation = "utf8mb4_general_ci"
+		}
+	}
+	if !reSessionName.MatchString(charset) {
+		return nil, fmt.Errorf("invalid charset value: %s", charset)
+	}
+	setNames := "SET NAMES " + charset
+	if collation != "" {
+		if !reSessionName.MatchString(collation) {
+			return nil, fmt.Errorf("invalid collation value: %s", collation)
+		}
+		setNames += " COLLATE " + collation
+	}
+	statements := []string{setNames}
+
+	var assignments []string
+	if setSQLMode {
+		assignments = append(assignments, "SESSION sql_mode = "+quoteSessionValue(sqlMode))
+	}
+	for _, entry := range strings.Split(sessionVars, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, ":")
+		if !ok || !reSessionName.MatchString(name) {
+			return nil, fmt.Errorf("invalid sessionVars entry: %s", entry)
+		}
+		assignments = append(assignments, "SESSION "+name+" = "+quoteSessionValue(value))
+	}
+	if len(assignments) > 0 {
+		statements = append(statements, "SET "+strings.Join(assignments, ", "))
+	}
+	return statements, nil
+}
+
+// quoteSessionValue returns value as a SQL literal: numbers are kept as is, anything else is quoted.
+func quoteSessionValue(value string) string {
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		return value
+	}
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `''`).Replace(value) + "'"
+}
+
+// secretValue is a credential read from a file or an environment variable.
+// The value is cached and re-read once it is older than interval, so rotated
+// credentials are used by new connections without restarting the plugin.
+type secretValue struct {
+	file     string
+	env      string
+	interval time.Duration
+	logger   hclog.Logger
+
+	mu     sync.Mutex
+	value  string
+	readAt time.Time
+}
+
+// newSecretValue creates a secret from the <name>File and <name>Env URI parameters,
+// removing them from params. It returns nil when neither is set.
+func newSecretValue(params url.Values, name string, interval time.Duration, logger hclog.Logger) (*secretValue, error) {
+	file := params.Get(name + "File")
+	env := params.Get(name + "Env")
+	params.Del(name + "File")
+	params.Del(name + "Env")
+	if file == "" && env == "" {
+		return nil, nil
+	}
+	if file != "" && env != "" {
+		return nil, fmt.Errorf("%sFile and %sEnv cannot be used together", name, name)
+	}
+	secret := &secretValue{file: file, env: env, interval: interval, logger: logger}
+	if _, err := secret.get(); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// get returns the current secret value. If re-reading fails, the last known value is kept.
+func (s *secretValue) get() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.readAt.IsZero() && time.Since(s.readAt) < s.interval {
+		return s.value, nil
+	}
+	value, err := s.read()
+	if err != nil {
+		if s.readAt.IsZero() {
+			return "", err
+		}
+		s.logger.Warn("failed to refresh secret, keeping previous value", "error", err.Error())
+		s.readAt = time.Now()
+		return s.value, nil
+	}
+	s.value = value
+	s.readAt = time.Now()
+	return s.value, nil
+}
+
+func (s *secretValue) read() (string, error) {
+	if s.file != "" {
+		data, err := os.ReadFile(s.file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read secret file: %w", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	value, ok := os.LookupEnv(s.env)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", s.env)
+	}
+	return value, nil
+}
+
+// dsnFor builds the DSN for addr, resolving the user name and password from secrets when configured.
+func (m *mysqlPlugin) dsnFor(cfg *mysql.Config, addr mysqlAddr) (string, error) {
+	if m.userSecret == nil && m.passwordSecret == nil {
+		return buildDSN(cfg, addr), nil
+	}
+	resolved := cfg.Clone()
+	var err error
+	if m.userSecret != nil {
+		if resolved.User, err = m.userSecret.get(); err != nil {
+			return "", err
+		}
+	}
+	if m.passwordSecret != nil {
+		if resolved.Passwd, err = m.passwordSecret.get(); err != nil {
+			return "", err
+		}
+	}
+	return buildDSN(resolved, addr), nil
+}
+
+// openPool opens a connection pool for addr. The DSN is rebuilt for every new connection
+// so that rotated secrets take effect, and each connection is initialized with the session settings.
+func (m *mysqlPlugin) openPool(cfg *mysql.Config, addr mysqlAddr) *sql.DB {
+	return openDB(&dsnConnector{
+		dsn: func() (string, error) {
+			return m.dsnFor(cfg, addr)
+		},
+		session: m.session,
+	})
+}
+
+// replica is a read replica connection pool together with its last known health.
+type replica struct {
+	addr    string
+	db      *sql.DB
+	healthy atomic.Bool
+}
+
+// check pings the replica and records whether it is healthy, logging every change of state.
+func (r *replica) check(ctx context.Context, logger hclog.Logger) {
+	err := r.db.PingContext(ctx)
+	wasHealthy := r.healthy.Swap(err == nil)
+	switch {
+	case err != nil && wasHealthy:
+		logger.Warn("replica is unhealthy", "replica", r.addr, "error", err.Error())
+	case err == nil && !wasHealthy:
+		logger.Info("replica is healthy", "replica", r.addr)
+	}
+}
+
+// checkReplicas periodically pings the given replicas so that failed ones are skipped and recovered ones are reused.
+// It returns once stop is closed.
+func checkReplicas(replicas []*replica, interval time.Duration, logger hclog.Logger, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for _, r := range replicas {
+				ctx, cancel := context.WithTimeout(context.Background(), interval)
+				r.check(ctx, logger)
+				cancel()
+			}
+		}
+	}
+}
+
+// closeReplicas stops the health check of the current replicas and closes their pools.
+func (m *mysqlPlugin) closeReplicas() {
+	if m.replicaStop != nil {
+		close(m.replicaStop)
+		m.replicaStop = nil
+	}
+	for _, r := range m.replicas {
+		r.db.Close()
+	}
+	m.replicas = nil
+}
+
+// readDB returns the pool used for read-only work: the next healthy replica in round-robin order,
+// or the primary when no replica is available or the request prefers read_your_writes.
+func (m *mysqlPlugin) readDB(ctx map[string]any) *sql.DB {
+	if len(m.replicas) == 0 || getPreference(ctx, "read_your_writes") == "true" {
+		return m.db
+	}
+	n := uint64(len(m.replicas))
+	start := m.replicaNext.Add(1)
+	for i := uint64(0); i < n; i++ {
+		r := m.replicas[(start+i)%n]
+		if r.healthy.Load() {
+			return r.db
+		}
+	}
+	return m.db
+}
+
+// readConn acquires a connection for read-only work, falling back to the primary
+// and marking the replica unhealthy when it cannot be reached. It returns the pool the connection came from.
+func (m *mysqlPlugin) readConn(ctx context.Context, ctxMap map[string]any) (*sql.Conn, *sql.DB, error) {
+	db := m.readDB(ctxMap)
+	conn, err := db.Conn(ctx)
+	if err == nil || db == m.db {
+		return conn, db, err
+	}
+	for _, r := range m.replicas {
+		if r.db == db {
+			if r.healthy.Swap(false) {
+				m.log().Warn("replica is unhealthy", "replica", r.addr, "error", err.Error())
+			}
+		}
+	}
+	conn, err = m.db.Conn(ctx)
+	return conn, m.db, err
+}
+
+// mysqlDriver is the driver used by the connectors that open every physical connection.
+// It is a package variable so tests can substitute a fake driver.
+var mysqlDriver driver.Driver = &mysql.MySQLDriver{}
+
+// openDriverConn opens a single physical connection with mysqlDriver and runs the session statements on it.
+func openDriverConn(ctx context.Context, dsn string, session []string) (driver.Conn, error) {
+	var conn driver.Conn
+	var err error
+	if dc, ok := mysqlDriver.(driver.DriverContext); ok {
+		var connector driver.Connector
+		if connector, err = dc.OpenConnector(dsn); err != nil {
+			return nil, err
+		}
+		conn, err = connector.Connect(ctx)
+	} else {
+		conn, err = mysqlDriver.Open(dsn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := initSession(ctx, conn, session); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to initialize session: %w", err)
+	}
+	return conn, nil
+}
+
+// initSession runs the session statements on a new connection.
+func initSession(ctx context.Context, conn driver.Conn, session []string) error {
+	if len(session) == 0 {
+		return nil
+	}
+	execer, ok := conn.(driver.ExecerContext)
+	if !ok {
+		return errors.New("driver connection does not support ExecContext")
+	}
+	for _, stmt := range session {
+		if _, err := execer.ExecContext(ctx, stmt, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dsnConnector is a driver.Connector that builds a fresh DSN for every new connection
+// and initializes its session.
+type dsnConnector struct {
+	dsn     func() (string, error)
+	session []string
+}
+
+// Connect implements driver.Connector.
+func (c *dsnConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	dsn, err := c.dsn()
+	if err != nil {
+		return nil, err
+	}
+	return openDriverConn(ctx, dsn, c.session)
+}
+
+// Driver implements driver.Connector.
+func (c *dsnConnector) Driver() driver.Driver {
+	return mysqlDriver
+}
+
+// failoverConnector dials the writable primary among several candidate hosts.
+// Every new physical connection is checked with @@global.read_only, so after a failover
+// the pool transparently reconnects to whichever candidate has been promoted.
+type failoverConnector struct {
+	hosts   []mysqlAddr
+	dsn     func(addr mysqlAddr) (string, error)
+	session []string
+	backoff time.Duration // initial delay before trying the next candidate
+	current atomic.Int32  // index of the last known primary
+	logger  hclog.Logger
+}
+
+// Connect implements driver.Connector.
+// Candidates are tried starting from the last known primary, waiting with exponential backoff
+// between them so that a promotion in progress has time to complete.
+func (c *failoverConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	start := int(c.current.Load())
+	var errs []error
+	for i := range c.hosts {
+		if i > 0 {
+			timer := time.NewTimer(retryDelay(c.backoff, i-1))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, fmt.Errorf("no writable primary found: %w", errors.Join(append(errs, ctx.Err())...))
+			case <-timer.C:
+			}
+		}
+		idx := (start + i) % len(c.hosts)
+		conn, err := c.connectWritable(ctx, c.hosts[idx])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.hosts[idx], err))
+			continue
+		}
+		if idx != start && c.current.CompareAndSwap(int32(start), int32(idx)) {
+			c.log().Warn("primary changed", "from", c.hosts[start].String(), "to", c.hosts[idx].String())
+		}
+		return conn, nil
+	}
+	return nil, fmt.Errorf("no writable primary found: %w", errors.Join(errs...))
+}
+
+// Driver implements driver.Connector.
+func (c *failoverConnector) Driver() driver.Driver {
+	return mysqlDriver
+}
+
+// log returns the connector's logger, or a logger that discards everything when none is set.
+func (c *failoverConnector) log() hclog.Logger {
+	if c.logger == nil {
+		return hclog.NewNullLogger()
+	}
+	return c.logger
+}
+
+// connectWritable opens a connection to addr and rejects it unless the server accepts writes.
+func (c *failoverConnector) connectWritable(ctx context.Context, addr mysqlAddr) (driver.Conn, error) {
+	dsn, err := c.dsn(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := openDriverConn(ctx, dsn, c.session)
+	if err != nil {
+		return nil, err
+	}
+	readOnly, err := isReadOnly(ctx, conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to check read_only: %w", err)
+	}
+	if readOnly {
+		conn.Close()
+		return nil, errors.New("server is read-only")
+	}
+	return conn, nil
+}
+
+// isReadOnly reports whether the server behind conn rejects writes.
+// super_read_only always implies read_only, so checking read_only also works on MariaDB,
+// which has no super_read_only variable.
+func isReadOnly(ctx context.Context, conn driver.Conn) (bool, error) {
+	queryer, ok := conn.(driver.QueryerContext)
+	if !ok {
+		return false, errors.New("driver does not support queries on raw connections")
+	}
+	rows, err := queryer.QueryContext(ctx, "SELECT @@global.read_only", nil)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	dest := make([]driver.Value, 1)
+	if err := rows.Next(dest); err != nil {
+		return false, err
+	}
+	switch v := dest[0].(type) {
+	case int64:
+		return v != 0, nil
+	case []byte:
+		return string(v) != "0", nil
+	case string:
+		return v != "0", nil
+	}
+	return false, fmt.Errorf("unexpected read_only value %v", dest[0])
+}
+
+// isFailoverError reports whether err means the primary went away or was demoted to read-only.
+func isFailoverError(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) {
+		return true
+	}
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		// Running with --read-only, read-only mode, server shutdown in progress
+		return mysqlErr.Number == 1290 || mysqlErr.Number == 1836 || mysqlErr.Number == 1053
+	}
+	var netErr *net.OpError
+	return errors.As(err, &netErr)
+}
+
+// commitError marks a failed COMMIT. The transaction may or may not have been applied,
+// so it is never retried after a failover.
+type commitError struct {
+	err error
+}
+
+func (e *commitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *commitError) Unwrap() error {
+	return e.err
+}
+
+// shouldFailover reports whether a statement that failed with err on db can be retried on a new primary.
+func (m *mysqlPlugin) shouldFailover(db *sql.DB, err error) bool {
+	var commitErr *commitError
+	return m.failover != nil && db == m.db && isFailoverError(err) && !errors.As(err, &commitErr)
+}
+
+// resetPrimaryPool drops idle connections to the old primary so the next statement reconnects
+// through the failover connector. err is the error that triggered the failover.
+func (m *mysqlPlugin) resetPrimaryPool(err error) {
+	m.log().Warn("primary connection failed, reconnecting", "error", err.Error())
+	m.db.SetMaxIdleConns(0)
+	m.db.SetMaxIdleConns(m.maxIdleConns)
+}
+
+// tlsConfigName is the name under which the plugin registers its TLS configuration with the driver.
+const tlsConfigName = "easyrest"
+
+// buildTLSConfig creates a tls.Config from the tlsCA, tlsCert, tlsKey, tlsServerName and tlsMode
+// URI parameters and removes them from params. It returns nil when none of them is set.
+// tlsMode is "verify-full" (default), "verify-ca" (chain only, no host name check) or "skip-verify".
+func buildTLSConfig(params url.Values) (*tls.Config, error) {
+	caFile := params.Get("tlsCA")
+	certFile := params.Get("tlsCert")
+	keyFile := params.Get("tlsKey")
+	serverName := params.Get("tlsServerName")
+	mode := params.Get("tlsMode")
+	for _, name := range []string{"tlsCA", "tlsCert", "tlsKey", "tlsServerName", "tlsMode"} {
+		params.Del(name)
+	}
+	if caFile == "" && certFile == "" && keyFile == "" && serverName == "" && mode == "" {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tlsCA file: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in tlsCA file %s", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("tlsCert and tlsKey must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	switch mode {
+	case "", "verify-full":
+	case "verify-ca":
+		// Verify the chain ourselves, without checking that the certificate matches the host name.
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("server did not present a certificate")
+			}
+			opts := x509.VerifyOptions{Roots: cfg.RootCAs, Intermediates: x509.NewCertPool()}
+			var leaf *x509.Certificate
+			for i, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return fmt.Errorf("failed to parse server certificate: %w", err)
+				}
+				if i == 0 {
+					leaf = cert
+				} else {
+					opts.Intermediates.AddCert(cert)
+				}
+			}
+			_, err := leaf.Verify(opts)
+			return err
+		}
+	case "skip-verify":
+		cfg.InsecureSkipVerify = true
+	default:
+		return nil, fmt.Errorf("invalid tlsMode value: %s", mode)
+	}
+	return cfg, nil
+}
+
+// latencyBuckets are the upper bounds, in seconds, of the operation latency histogram.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metrics collects the statistics exposed on the metrics listener. All methods are no-ops
+// on a nil *metrics, so nothing is recorded unless metricsAddr is configured.
+type metrics struct {
+	mu          sync.Mutex
+	operations  map[operationKey]*operationStats
+	commits     atomic.Uint64
+	rollbacks   atomic.Uint64
+	deadlocks   atomic.Uint64 // transactions retried after a deadlock
+	lockWaits   atomic.Uint64 // transactions retried after a lock wait timeout
+	cacheHits   atomic.Uint64
+	cacheMisses atomic.Uint64
+}
+
+type operationKey struct {
+	operation string
+	table     string
+}
+
+type operationStats struct {
+	count   uint64
+	errors  uint64
+	buckets []uint64 // cumulative counts per latencyBuckets entry
+	sum     float64
+}
+
+func newMetrics() *metrics {
+	return &metrics{operations: make(map[operationKey]*operationStats)}
+}
+
+// unknownTable is the table label of calls whose table or routine may not exist.
+const unknownTable = "unknown"
+
+// observe records a call of operation on table (or routine) that started at start and returned *err.
+// The name comes from the request, so it is only used as a label once MySQL has run a statement on it;
+// calls rejected before that, or with an error MySQL also returns for missing objects, are recorded
+// under unknownTable so that requests cannot create a series per name.
+func (mt *metrics) observe(operation, table string, start time.Time, err *error) {
+	if mt == nil {
+		return
+	}
+	if !objectExists(*err) {
+		table = unknownTable
+	}
+	seconds := time.Since(start).Seconds()
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	key := operationKey{operation: operation, table: table}
+	stats, ok := mt.operations[key]
+	if !ok {
+		stats = &operationStats{buckets: make([]uint64, len(latencyBuckets))}
+		mt.operations[key] = stats
+	}
+	stats.count++
+	if *err != nil {
+		stats.errors++
+	}
+	stats.sum += seconds
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			stats.buckets[i]++
+		}
+	}
+}
+
+// objectExists reports whether a call that returned err is known to have reached an existing table or routine.
+func objectExists(err error) bool {
+	if err == nil {
+		return true
+	}
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	// Missing objects are reported as not found, or as access denied when the user lacks privileges.
+	kind := mysqlErrorKinds[mysqlErr.Number]
+	return kind != errNotFound && kind != errPermissionDenied
+}
+
+// transaction records the outcome of a transaction.
+func (mt *metrics) transaction(committed bool) {
+	if mt == nil {
+		return
+	}
+	if committed {
+		mt.commits.Add(1)
+	} else {
+		mt.rollbacks.Add(1)
+	}
+}
+
+// retry records a transaction retried after err, a deadlock or lock wait timeout.
+func (mt *metrics) retry(err error) {
+	if mt == nil {
+		return
+	}
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == 1213 {
+		mt.deadlocks.Add(1)
+	} else {
+		mt.lockWaits.Add(1)
+	}
+}
+
+// cacheLookup records a cache hit or miss.
+func (mt *metrics) cacheLookup(hit bool) {
+	if mt == nil {
+		return
+	}
+	if hit {
+		mt.cacheHits.Add(1)
+	} else {
+		mt.cacheMisses.Add(1)
+	}
+}
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeMetricHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writeMetrics writes the plugin metrics in the Prometheus text exposition format.
+func (m *mysqlPlugin) writeMetrics(w io.Writer) {
+	mt := m.metrics
+	if mt == nil {
+		return
+	}
+
+	mt.mu.Lock()
+	keys := make([]operationKey, 0, len(mt.operations))
+	stats := make(map[operationKey]operationStats, len(mt.operations))
+	for key, s := range mt.operations {
+		keys = append(keys, key)
+		stats[key] = operationStats{count: s.count, errors: s.errors, buckets: append([]uint64(nil), s.buckets...), sum: s.sum}
+	}
+	mt.mu.Unlock()
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].operation != keys[j].operation {
+			return keys[i].operation < keys[j].operation
+		}
+		return keys[i].table < keys[j].table
+	})
+	labels := func(key operationKey) string {
+		return fmt.Sprintf(`operation="%s",table="%s"`, metricLabelEscaper.Replace(key.operation), metricLabelEscaper.Replace(key.table))
+	}
+
+	writeMetricHeader(w, "easyrest_mysql_operations_total", "counter", "Plugin operations by operation and table or routine.")
+	for _, key := range keys {
+		fmt.Fprintf(w, "easyrest_mysql_operations_total{%s} %d\n", labels(key), stats[key].count)
+	}
+	writeMetricHeader(w, "easyrest_mysql_operation_errors_total", "counter", "Failed plugin operations by operation and table or routine.")
+	for _, key := range keys {
+		fmt.Fprintf(w, "easyrest_mysql_operation_errors_total{%s} %d\n", labels(key), stats[key].errors)
+	}
+	writeMetricHeader(w, "easyrest_mysql_operation_duration_seconds", "histogram", "Latency of plugin operations in seconds.")
+	for _, key := range keys {
+		s := stats[key]
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "easyrest_mysql_operation_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels(key), strconv.FormatFloat(bound, 'g', -1, 64), s.buckets[i])
+		}
+		fmt.Fprintf(w, "easyrest_mysql_operation_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels(key), s.count)
+		fmt.Fprintf(w, "easyrest_mysql_operation_duration_seconds_sum{%s} %s\n", labels(key), strconv.FormatFloat(s.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "easyrest_mysql_operation_duration_seconds_count{%s} %d\n", labels(key), s.count)
+	}
+
+	writeMetricHeader(w, "easyrest_mysql_transactions_total", "counter", "Finished transactions by result.")
+	fmt.Fprintf(w, "easyrest_mysql_transactions_total{result=\"commit\"} %d\n", mt.commits.Load())
+	fmt.Fprintf(w, "easyrest_mysql_transactions_total{result=\"rollback\"} %d\n", mt.rollbacks.Load())
+	writeMetricHeader(w, "easyrest_mysql_transaction_retries_total", "counter", "Transactions re-run by the error that aborted them.")
+	fmt.Fprintf(w, "easyrest_mysql_transaction_retries_total{reason=\"deadlock\"} %d\n", mt.deadlocks.Load())
+	fmt.Fprintf(w, "easyrest_mysql_transaction_retries_total{reason=\"lock_wait_timeout\"} %d\n", mt.lockWaits.Load())
+
+	hits, misses := mt.cacheHits.Load(), mt.cacheMisses.Load()
+	writeMetricHeader(w, "easyrest_mysql_cache_requests_total", "counter", "Cache lookups by result.")
+	fmt.Fprintf(w, "easyrest_mysql_cache_requests_total{result=\"hit\"} %d\n", hits)
+	fmt.Fprintf(w, "easyrest_mysql_cache_requests_total{result=\"miss\"} %d\n", misses)
+	ratio := 0.0
+	if hits+misses > 0 {
+		ratio = float64(hits) / float64(hits+misses)
+	}
+	writeMetricHeader(w, "easyrest_mysql_cache_hit_ratio", "gauge", "Share of cache lookups that were hits.")
+	fmt.Fprintf(w, "easyrest_mysql_cache_hit_ratio %s\n", strconv.FormatFloat(ratio, 'g', -1, 64))
+
+	pools := []struct {
+		name string
+		db   *sql.DB
+	}{{"primary", m.db}}
+	for _, r := range m.replicas {
+		pools = append(pools, struct {
+			name string
+			db   *sql.DB
+		}{r.addr, r.db})
+	}
+	gauges := []struct {
+		name, kind, help string
+		value            func(sql.DBStats) float64
+	}{
+		{"easyrest_mysql_pool_max_open_connections", "gauge", "Maximum number of open connections.", func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) }},
+		{"easyrest_mysql_pool_open_connections", "gauge", "Established connections, in use and idle.", func(s sql.DBStats) float64 { return float64(s.OpenConnections) }},
+		{"easyrest_mysql_pool_in_use_connections", "gauge", "Connections currently in use.", func(s sql.DBStats) float64 { return float64(s.InUse) }},
+		{"easyrest_mysql_pool_idle_connections", "gauge", "Idle connections.", func(s sql.DBStats) float64 { return float64(s.Idle) }},
+		{"easyrest_mysql_pool_wait_count_total", "counter", "Connections waited for.", func(s sql.DBStats) float64 { return float64(s.WaitCount) }},
+		{"easyrest_mysql_pool_wait_duration_seconds_total", "counter", "Time spent waiting for connections.", func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }},
+		{"easyrest_mysql_pool_max_idle_closed_total", "counter", "Connections closed due to maxIdleConns.", func(s sql.DBStats) float64 { return float64(s.MaxIdleClosed) }},
+		{"easyrest_mysql_pool_max_idle_time_closed_total", "counter", "Connections closed due to connMaxIdleTime.", func(s sql.DBStats) float64 { return float64(s.MaxIdleTimeClosed) }},
+		{"easyrest_mysql_pool_max_lifetime_closed_total", "counter", "Connections closed due to connMaxLifetime.", func(s sql.DBStats) float64 { return float64(s.MaxLifetimeClosed) }},
+	}
+	poolStats := make([]sql.DBStats, len(pools))
+	for i, pool := range pools {
+		if pool.db != nil {
+			poolStats[i] = pool.db.Stats()
+		}
+	}
+	for _, g := range gauges {
+		writeMetricHeader(w, g.name, g.kind, g.help)
+		for i, pool := range pools {
+			if pool.db != nil {
+				fmt.Fprintf(w, "%s{pool=\"%s\"} %s\n", g.name, metricLabelEscaper.Replace(pool.name), strconv.FormatFloat(g.value(poolStats[i]), 'g', -1, 64))
+			}
+		}
+	}
+}
+
+// handleMetrics serves the metrics endpoint.
+func (m *mysqlPlugin) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.writeMetrics(w)
+}
+
+// serveMetrics exposes the metrics on http://addr/metrics, replacing a previously started listener.
+func (m *mysqlPlugin) serveMetrics(addr string) error {
+	if m.metricsServer != nil {
+		m.metricsServer.Close()
+		m.metricsServer = nil
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to start metrics listener: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", m.handleMetrics)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	m.metricsServer = server
+	logger := m.log()
+	logger.Info("serving metrics", "url", "http://"+listener.Addr().String()+"/metrics")
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("metrics listener stopped", "error", err.Error())
+		}
+	}()
+	return nil
+}
+
+// slowQueryLog logs generated statements that run longer than threshold. All methods are
+// no-ops on a nil *slowQueryLog, so nothing is timed unless slowQueryThreshold is configured.
+type slowQueryLog struct {
+	threshold time.Duration
+	params    string // how bound values are logged: redact, truncate or full
+	maxLength int    // maximum length of the SQL text and of truncated values
+	logger    hclog.Logger
+}
+
+// newSlowQueryLog creates the slow query log from the slowQueryThreshold, slowQueryParams and
+// slowQueryMaxLength URI parameters, removing them from params. It returns nil when no threshold is set.
+func newSlowQueryLog(params url.Values) (*slowQueryLog, error) {
+	threshold, mode, maxLength := params.Get("slowQueryThreshold"), params.Get("slowQueryParams"), params.Get("slowQueryMaxLength")
+	params.Del("slowQueryThreshold")
+	params.Del("slowQueryParams")
+	params.Del("slowQueryMaxLength")
+
+	s := &slowQueryLog{params: "redact", maxLength: 256}
+	if mode != "" {
+		s.params = strings.ToLower(mode)
+		if s.params != "redact" && s.params != "truncate" && s.params != "full" {
+			return nil, fmt.Errorf("invalid slowQueryParams value: %s", mode)
+		}
+	}
+	if maxLength != "" {
+		n, err := strconv.Atoi(maxLength)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid slowQueryMaxLength value: %s", maxLength)
+		}
+		s.maxLength = n
+	}
+	if threshold == "" {
+		return nil, nil
+	}
+	ms, err := strconv.Atoi(threshold)
+	if err != nil || ms < 0 {
+		return nil, fmt.Errorf("invalid slowQueryThreshold value: %s", threshold)
+	}
+	s.threshold = time.Duration(ms) * time.Millisecond
+	s.logger = newLogger()
+	return s, nil
+}
+
+// newLogger creates the structured logger of the plugin.
+func newLogger() hclog.Logger {
+	return hclog.New(&hclog.LoggerOptions{
+		Name:       "mysql",
+		Level:      hclog.Info,
+		Output:     os.Stderr,
+		JSONFormat: true, // go-plugin forwards JSON log lines to the EasyREST logger
+	})
+}
+
+// log records query if it ran for longer than the threshold since start.
+// rows is the number of returned or affected rows.
+func (s *slowQueryLog) log(operation, table, query string, args []any, start time.Time, rows int64, err error) {
+	if s == nil {
+		return
+	}
+	duration := time.Since(start)
+	if duration < s.threshold {
+		return
+	}
+	fields := []any{
+		"operation", operation,
+		"table", table,
+		"duration", duration,
+		"rows", rows,
+		"sql", truncateString(query, s.maxLength),
+	}
+	switch s.params {
+	case "redact":
+		fields = append(fields, "args", fmt.Sprintf("[%d redacted]", len(args)))
+	default:
+		values := make([]string, len(args))
+		for i, arg := range args {
+			values[i] = formatLogValue(arg)
+			if s.params == "truncate" {
+				values[i] = truncateString(values[i], s.maxLength)
+			}
+		}
+		fields = append(fields, "args", values)
+	}
+	if err != nil {
+		fields = append(fields, "error", err.Error())
+	}
+	s.logger.Warn("slow query", fields...)
+}
+
+// rowsAffected returns the affected row count of res, or 0 when it is not available.
+func rowsAffected(res sql.Result) int64 {
+	if res == nil {
+		return 0
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// formatLogValue renders a bound value for the slow query log.
+func formatLogValue(v any) string {
+	switch val := v.(type) {
+	case nil:
+		return "NULL"
+	case []byte:
+		return string(val)
+	case time.Time:
+		return val.Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+// truncateString shortens s to at most n runes, marking the cut with "...".
+func truncateString(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n]) + "..."
+}
+
+// tracerName is the instrumentation scope of the plugin's spans.
+const tracerName = "github.com/onegreyonewhite/easyrest-plugin-mysql"
+
+// newTracerProvider creates a tracer provider that exports spans over OTLP/HTTP to endpoint,
+// a URL such as http://otel-collector:4318.
+func newTracerProvider(endpoint string) (*sdktrace.TracerProvider, error) {
+	if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid otlpEndpoint value: %s", endpoint)
+	}
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName("easyrest-plugin-mysql"),
+		semconv.ServiceVersion(Version),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace resource: %w", err)
+	}
+	return sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res)), nil
+}
+
+// tracerShutdownTimeout bounds how long buffered spans are flushed when the tracer provider is stopped.
+const tracerShutdownTimeout = 5 * time.Second
+
+// shutdownTracer flushes the buffered spans and stops the tracer provider, if any.
+func (m *mysqlPlugin) shutdownTracer() {
+	if m.tracerProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tracerShutdownTimeout)
+	defer cancel()
+	if err := m.tracerProvider.Shutdown(ctx); err != nil {
+		m.log().Warn("failed to shut down tracer provider", "error", err.Error())
+	}
+	m.tracerProvider = nil
+	m.tracer = nil
+}
+
+// headerCarrier adapts request headers propagated in the ctx map to a propagation.TextMapCarrier.
+type headerCarrier map[string]any
+
+// Get implements propagation.TextMapCarrier.
+func (c headerCarrier) Get(key string) string {
+	switch val := c[strings.ToLower(key)].(type) {
+	case string:
+		return val
+	case []string:
+		if len(val) > 0 {
+			return val[0]
+		}
+	case []any:
+		if len(val) > 0 {
+			return fmt.Sprint(val[0])
+		}
+	}
+	return ""
+}
+
+// Set implements propagation.TextMapCarrier.
+func (c headerCarrier) Set(key, value string) {
+	c[strings.ToLower(key)] = value
+}
+
+// Keys implements propagation.TextMapCarrier.
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// traceContext returns a context carrying the W3C trace parent propagated in the ctx map,
+// taken from ctx["headers"] or, failing that, from the top level of ctx.
+func traceContext(ctx map[string]any) context.Context {
+	carrier := headerCarrier(ctx)
+	if headers, ok := ctx["headers"].(map[string]any); ok && headerCarrier(headers).Get("traceparent") != "" {
+		carrier = headers
+	}
+	return propagation.TraceContext{}.Extract(context.Background(), carrier)
+}
+
+// startOperation starts the span of a DBPlugin method as a child of the trace parent propagated in ctxMap.
+// Following the database semantic conventions, the span is named after the statement and its target.
+func (m *mysqlPlugin) startOperation(ctxMap map[string]any, method, operation, target string) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{
+		semconv.DBSystemMySQL,
+		semconv.DBOperationName(operation),
+		semconv.CodeFunction(method),
+	}
+	if m.dbName != "" {
+		attrs = append(attrs, semconv.DBNamespace(m.dbName))
+	}
+	name := operation
+	if target != "" {
+		name += " " + target
+		if operation != "CALL" {
+			attrs = append(attrs, semconv.DBCollectionName(target))
+		}
+	}
+	return m.startSpan(traceContext(ctxMap), name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+// startSpan starts a child span of ctx. Without tracing configured the span is a no-op.
+func (m *mysqlPlugin) startSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if m.tracer == nil {
+		return noop.Tracer{}.Start(ctx, name, opts...)
+	}
+	return m.tracer.Start(ctx, name, opts...)
+}
+
+// endSpan records err on span, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 	}
-	return results, nil
+	span.End()
 }
 
-// InitConnection opens the MySQL connection, sets utf8mb4, loads routines.
+// InitConnection opens the MySQL connection, configures the session of every new connection, loads routines.
+// The URI grammar is described at mysqlURI. When several comma-separated hosts are listed,
+// the plugin connects to the one that accepts writes and follows the primary after a failover.
 // Supports the following URI parameters:
 // - maxOpenConns: Maximum number of open connections (default: 100)
 // - maxIdleConns: Maximum number of idle connections (default: 20)
@@ -171,22 +3095,69 @@ func scanRows(r rowScanner) ([]map[string]any, error) {
 // - connMaxIdleTime: Connection idle time in minutes (default: 10)
 // - timeout: Query timeout in seconds (default: 30)
 // - parseTime: Parse MySQL TIME/TIMESTAMP/DATETIME as time.Time
+// - softDelete: Tables whose rows are soft-deleted, as table:column[:mode],...
+// - isolationLevel: Default transaction isolation level (default: server setting)
+// - readSnapshot: Run TableGet in a read-only consistent snapshot (default: false)
+// - maxRetries: Retries of transactions failing with a deadlock or lock wait timeout (default: 3)
+// - retryBackoff: Initial delay between retries in milliseconds (default: 50)
+// - replicas: Comma-separated read replica hosts (see parseMySQLAddr) used for reads
+// - replicaCheckInterval: Replica health check interval in seconds (default: 10)
+// - tlsCA, tlsCert, tlsKey, tlsServerName, tlsMode: TLS settings (see buildTLSConfig)
+// - passwordFile, passwordEnv, userFile, userEnv: Read credentials from a file or environment variable
+// - secretRefreshInterval: Credential re-read interval in seconds (default: 60)
+// - charset, collation: Connection character set and collation (default: utf8mb4, utf8mb4_general_ci)
+// - sqlMode: Session sql_mode (default: server setting)
+// - sessionVars: Other session variables, as name:value,...
+// - metricsAddr: Address of the Prometheus metrics listener, e.g. 127.0.0.1:9187 (default: disabled)
+// - slowQueryThreshold: Log statements slower than this many milliseconds (default: disabled)
+// - slowQueryParams: How bound values are logged: redact, truncate or full (default: redact)
+// - slowQueryMaxLength: Maximum logged length of the SQL text and truncated values (default: 256)
+// - otlpEndpoint: OTLP/HTTP collector URL for trace export, e.g. http://localhost:4318 (default: disabled)
+// - explainRole: Claim value allowed to request query plans with the "explain" preference (default: disabled)
+// - explainClaim: Dotted path of the claim checked for explainRole (default: role)
+// - accessFile: YAML file with table, routine and column access rules (see accessRules)
+// - allowTables, denyTables, allowRoutines, denyRoutines, denyColumns: Comma-separated access patterns
+// - tablePermissions: Operations allowed on tables, as table:operation|operation,...
+// - rowPolicies, policyBypassRole, policyBypassClaim: Row policies, as table:column=erctx.key,...
+// - maskColumns, unmaskRole, unmaskClaim: Column masks, as column:mode,...
+// - maskSecret: HMAC key of hash masks, required when a mask uses the hash mode
+// - auditColumns: Columns set from the request context, as table:column=key[:operation|operation],...
+// - auditTable: Table receiving a record of every changed row, created if missing (default: disabled)
+// - auditClaims: Comma-separated claims copied into audit records (default: sub)
+// - tenantClaim: Context value selecting the schema of each request, e.g. claims_tenant (default: disabled)
+// - tenantSchemas: Comma-separated patterns of allowed tenant schemas, required with tenantClaim
+// - tenantSchemaPrefix: Prefix added to the tenant value to form the schema name
+// - tenantCacheTTL: Lifetime of cached tenant schema metadata in seconds (default: 300)
+// - schemas: Comma-separated schemas whose tables and routines are exposed as schema.name
+// - maxEmbedDepth: Nesting limit of related resources embedded with table(columns) selects; 0 disables them (default: 3)
+// - relationCacheTTL: Lifetime of the cached foreign keys and columns used to embed related resources in seconds (default: 300)
 func (m *mysqlPlugin) InitConnection(uri string) error {
 	if !strings.HasPrefix(uri, "mysql://") {
 		return errors.New("invalid MySQL URI")
 	}
 
-	parsedURI, err := url.Parse(uri)
+	parsedURI, err := parseMySQLURI(uri)
 	if err != nil {
 		return fmt.Errorf("failed to parse URI: %w", err)
 	}
 
-	queryParams := parsedURI.Query()
+	if m.logger == nil {
+		m.logger = newLogger()
+	}
+
+	queryParams := parsedURI.Params
 	maxOpenConns := 100
 	maxIdleConns := 20
 	connMaxLifetime := 5
 	connMaxIdleTime := 10
 	timeout := 30 // Timeout in seconds
+	maxRetries := 3
+	retryBackoff := 50 // Backoff in milliseconds
+	var replicaAddrs []mysqlAddr
+	replicaCheckInterval := 10  // Health check interval in seconds
+	secretRefreshInterval := 60 // Secret re-read interval in seconds
+	maxEmbedDepth := 3
+	relationCacheTTL := 300 // Foreign key and column cache lifetime in seconds
 
 	queryParams.Del("autoCleanup")
 
@@ -226,44 +3197,187 @@ func (m *mysqlPlugin) InitConnection(uri string) error {
 		queryParams.Del("timeout")
 	}
 
-	var dsn strings.Builder
+	if val := queryParams.Get("maxRetries"); val != "" {
+		if n, err := fmt.Sscanf(val, "%d", &maxRetries); err != nil || n != 1 || maxRetries < 0 {
+			return fmt.Errorf("invalid maxRetries value: %s", val)
+		}
+		queryParams.Del("maxRetries")
+	}
 
-	if parsedURI.User != nil {
-		dsn.WriteString(parsedURI.User.Username())
-		if password, ok := parsedURI.User.Password(); ok {
-			dsn.WriteByte(':')
-			dsn.WriteString(password)
+	if val := queryParams.Get("retryBackoff"); val != "" {
+		if n, err := fmt.Sscanf(val, "%d", &retryBackoff); err != nil || n != 1 || retryBackoff < 0 {
+			return fmt.Errorf("invalid retryBackoff value: %s", val)
 		}
-		dsn.WriteByte('@')
+		queryParams.Del("retryBackoff")
 	}
 
-	host := parsedURI.Hostname()
-	port := parsedURI.Port()
-	if strings.Contains(host, "(") && strings.Contains(host, ")") {
-		dsn.WriteString(host)
-	} else {
-		dsn.WriteString("tcp(")
-		dsn.WriteString(host)
-		if port != "" {
-			dsn.WriteByte(':')
-			dsn.WriteString(port)
+	if val := queryParams.Get("softDelete"); val != "" {
+		softDelete, err := parseSoftDelete(val)
+		if err != nil {
+			return err
+		}
+		m.softDelete = softDelete
+		queryParams.Del("softDelete")
+	}
+
+	if val := queryParams.Get("isolationLevel"); val != "" {
+		level, err := parseIsolationLevel(val)
+		if err != nil {
+			return err
+		}
+		m.isolationLevel = level
+		queryParams.Del("isolationLevel")
+	}
+
+	if val := queryParams.Get("readSnapshot"); val != "" {
+		readSnapshot, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("invalid readSnapshot value: %s", val)
+		}
+		m.readSnapshot = readSnapshot
+		queryParams.Del("readSnapshot")
+	}
+
+	if val := queryParams.Get("replicas"); val != "" {
+		for _, host := range strings.Split(val, ",") {
+			if host = strings.TrimSpace(host); host == "" {
+				continue
+			}
+			addr, err := parseMySQLAddr(host)
+			if err != nil {
+				return fmt.Errorf("invalid replicas value: %w", err)
+			}
+			replicaAddrs = append(replicaAddrs, addr)
+		}
+		queryParams.Del("replicas")
+	}
+
+	if val := queryParams.Get("replicaCheckInterval"); val != "" {
+		if n, err := fmt.Sscanf(val, "%d", &replicaCheckInterval); err != nil || n != 1 || replicaCheckInterval <= 0 {
+			return fmt.Errorf("invalid replicaCheckInterval value: %s", val)
+		}
+		queryParams.Del("replicaCheckInterval")
+	}
+
+	if val := queryParams.Get("maxEmbedDepth"); val != "" {
+		if n, err := fmt.Sscanf(val, "%d", &maxEmbedDepth); err != nil || n != 1 || maxEmbedDepth < 0 {
+			return fmt.Errorf("invalid maxEmbedDepth value: %s", val)
 		}
-		dsn.WriteByte(')')
+		queryParams.Del("maxEmbedDepth")
 	}
 
-	if len(parsedURI.Path) > 1 {
-		dsn.WriteByte('/')
-		dsn.WriteString(strings.TrimPrefix(parsedURI.Path, "/"))
+	if val := queryParams.Get("relationCacheTTL"); val != "" {
+		if n, err := fmt.Sscanf(val, "%d", &relationCacheTTL); err != nil || n != 1 || relationCacheTTL < 0 {
+			return fmt.Errorf("invalid relationCacheTTL value: %s", val)
+		}
+		queryParams.Del("relationCacheTTL")
+	}
+
+	if val := queryParams.Get("secretRefreshInterval"); val != "" {
+		if n, err := fmt.Sscanf(val, "%d", &secretRefreshInterval); err != nil || n != 1 || secretRefreshInterval < 0 {
+			return fmt.Errorf("invalid secretRefreshInterval value: %s", val)
+		}
+		queryParams.Del("secretRefreshInterval")
+	}
+	if m.userSecret, err = newSecretValue(queryParams, "user", time.Duration(secretRefreshInterval)*time.Second, m.log()); err != nil {
+		return fmt.Errorf("failed to resolve user: %w", err)
+	}
+	if m.passwordSecret, err = newSecretValue(queryParams, "password", time.Duration(secretRefreshInterval)*time.Second, m.log()); err != nil {
+		return fmt.Errorf("failed to resolve password: %w", err)
+	}
+
+	if m.session, err = parseSessionSettings(queryParams); err != nil {
+		return err
+	}
+	if m.access, err = newAccessRules(queryParams); err != nil {
+		return err
+	}
+	if m.audit, err = newAuditLog(queryParams); err != nil {
+		return err
+	}
+	if m.tenants, err = newTenantRouting(queryParams); err != nil {
+		return err
+	}
+	if m.schemas, err = parseSchemas(queryParams.Get("schemas")); err != nil {
+		return err
+	}
+	queryParams.Del("schemas")
+	if m.audit != nil {
+		// Audit records are immutable: the audit table can at most be read through the API.
+		if m.access == nil {
+			m.access = &accessRules{}
+		}
+		if m.access.Permissions == nil {
+			m.access.Permissions = make(map[string][]string)
+		}
+		ops := m.access.Permissions[m.audit.table]
+		if ops == nil {
+			ops = []string{opSelect}
+		}
+		m.access.Permissions[m.audit.table] = slices.DeleteFunc(slices.Clone(ops), func(op string) bool { return op != opSelect })
+	}
+	m.explainRole = queryParams.Get("explainRole")
+	m.explainClaim = "role"
+	if val := queryParams.Get("explainClaim"); val != "" {
+		m.explainClaim = val
+	}
+	queryParams.Del("explainRole")
+	queryParams.Del("explainClaim")
+	metricsAddr := queryParams.Get("metricsAddr")
+	queryParams.Del("metricsAddr")
+	if m.slowLog, err = newSlowQueryLog(queryParams); err != nil {
+		return err
+	}
+	if val := queryParams.Get("otlpEndpoint"); val != "" {
+		provider, err := newTracerProvider(val)
+		if err != nil {
+			return err
+		}
+		m.shutdownTracer()
+		m.tracerProvider = provider
+		m.tracer = provider.Tracer(tracerName, trace.WithInstrumentationVersion(Version))
+		queryParams.Del("otlpEndpoint")
 	}
 
-	if len(queryParams) > 0 {
-		dsn.WriteByte('?')
-		dsn.WriteString(queryParams.Encode())
+	tlsConfig, err := buildTLSConfig(queryParams)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		if err := mysql.RegisterTLSConfig(tlsConfigName, tlsConfig); err != nil {
+			return fmt.Errorf("failed to register TLS config: %w", err)
+		}
+		queryParams.Set("tls", tlsConfigName)
 	}
 
-	db, err := openDB("mysql", dsn.String())
+	// The remaining parameters belong to the driver; let it validate them.
+	driverConfig, err := mysql.ParseDSN("/?" + queryParams.Encode())
 	if err != nil {
-		return fmt.Errorf("failed to open MySQL: %w", err)
+		return fmt.Errorf("invalid driver parameters: %w", err)
+	}
+	driverConfig.User = parsedURI.User
+	driverConfig.Passwd = parsedURI.Password
+	driverConfig.DBName = parsedURI.DBName
+	m.dbName = parsedURI.DBName
+	// The tables of the database of the DSN are already exposed unqualified.
+	m.schemas = slices.DeleteFunc(m.schemas, func(schema string) bool { return schema == m.dbName })
+
+	var db *sql.DB
+	if len(parsedURI.Hosts) > 1 {
+		// Several candidate hosts: connect to whichever one currently accepts writes.
+		m.failover = &failoverConnector{
+			hosts: parsedURI.Hosts,
+			dsn: func(addr mysqlAddr) (string, error) {
+				return m.dsnFor(driverConfig, addr)
+			},
+			session: m.session,
+			backoff: time.Duration(retryBackoff) * time.Millisecond,
+			logger:  m.log(),
+		}
+		db = openDB(m.failover)
+	} else {
+		m.failover = nil
+		db = m.openPool(driverConfig, parsedURI.Hosts[0])
 	}
 
 	db.SetMaxOpenConns(maxOpenConns)
@@ -271,6 +3385,11 @@ func (m *mysqlPlugin) InitConnection(uri string) error {
 	db.SetConnMaxLifetime(time.Duration(connMaxLifetime) * time.Minute)
 	db.SetConnMaxIdleTime(time.Duration(connMaxIdleTime) * time.Minute)
 	m.defaultTimeout = time.Duration(timeout) * time.Second
+	m.maxRetries = maxRetries
+	m.maxEmbedDepth = maxEmbedDepth
+	m.relations = newRelationCache(time.Duration(relationCacheTTL) * time.Second)
+	m.retryBackoff = time.Duration(retryBackoff) * time.Millisecond
+	m.maxIdleConns = maxIdleConns
 
 	ctx, cancel := context.WithTimeout(context.Background(), m.defaultTimeout)
 	defer cancel()
@@ -280,29 +3399,112 @@ func (m *mysqlPlugin) InitConnection(uri string) error {
 	}
 
 	m.db = db
-	_, err = m.db.ExecContext(ctx, "SET NAMES utf8mb4 COLLATE utf8mb4_general_ci")
-	if err != nil {
-		return fmt.Errorf("failed to set charset: %w", err)
+
+	if err := m.audit.createTable(ctx, db); err != nil {
+		return err
+	}
+
+	m.closeReplicas()
+	for _, addr := range replicaAddrs {
+		replicaDB := m.openPool(driverConfig, addr)
+		replicaDB.SetMaxOpenConns(maxOpenConns)
+		replicaDB.SetMaxIdleConns(maxIdleConns)
+		replicaDB.SetConnMaxLifetime(time.Duration(connMaxLifetime) * time.Minute)
+		replicaDB.SetConnMaxIdleTime(time.Duration(connMaxIdleTime) * time.Minute)
+		r := &replica{addr: addr.String(), db: replicaDB}
+		// An unreachable replica does not prevent startup; the health check brings it back later.
+		if err := replicaDB.PingContext(ctx); err != nil {
+			m.log().Warn("replica is not reachable, reads go to the primary until it recovers", "replica", r.addr, "error", err.Error())
+		} else {
+			r.healthy.Store(true)
+		}
+		m.replicas = append(m.replicas, r)
+	}
+	if len(m.replicas) > 0 {
+		m.replicaStop = make(chan struct{})
+		go checkReplicas(m.replicas, time.Duration(replicaCheckInterval)*time.Second, m.log(), m.replicaStop)
 	}
 
 	if err := m.loadRoutines(); err != nil {
 		return fmt.Errorf("failed to load routines: %w", err)
 	}
 
+	if metricsAddr != "" {
+		if m.metrics == nil {
+			m.metrics = newMetrics()
+		}
+		if err := m.serveMetrics(metricsAddr); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-// loadRoutines populates m.routines from information_schema.parameters.
+// loadRoutines populates m.routines and m.schemaRoutines from information_schema.parameters.
 func (m *mysqlPlugin) loadRoutines() error {
-	m.routines = make(map[string]RoutineInfo)
+	routines, err := m.queryRoutines("")
+	if err != nil {
+		return err
+	}
+	m.routines = routines
+	m.schemaRoutines = make(map[string]map[string]RoutineInfo, len(m.schemas))
+	for _, schema := range m.schemas {
+		if m.schemaRoutines[schema], err = m.queryRoutines(schema); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schemaCondition returns the expression naming schema in information_schema queries:
+// DATABASE() for the database of the DSN, or a placeholder bound to schema.
+func schemaCondition(schema string) (string, []any) {
+	if schema == "" {
+		return "DATABASE()", nil
+	}
+	return "?", []any{schema}
+}
+
+// quoteIdentifier quotes name with backticks for use in SQL text.
+func quoteIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// quoteString quotes s as a SQL string literal.
+func quoteString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", "''").Replace(s) + "'"
+}
+
+// quoteQualified returns the SQL reference to table or routine name of schema, quoted with backticks,
+// since schema names may start with a digit or $. An empty schema is the database of the DSN.
+func quoteQualified(schema, name string) string {
+	if schema == "" {
+		return quoteIdentifier(name)
+	}
+	return quoteIdentifier(schema) + "." + quoteIdentifier(name)
+}
+
+// qualify prefixes name with schema unless schema is the database of the DSN.
+func qualify(schema, name string) string {
+	if schema == "" {
+		return name
+	}
+	return schema + "." + name
+}
+
+// queryRoutines reads the routines of schema from information_schema.parameters.
+func (m *mysqlPlugin) queryRoutines(schema string) (map[string]RoutineInfo, error) {
+	routines := make(map[string]RoutineInfo)
+	cond, args := schemaCondition(schema)
 	query := `
 SELECT SPECIFIC_NAME, PARAMETER_NAME, DATA_TYPE, PARAMETER_MODE, ORDINAL_POSITION
 FROM information_schema.parameters
-WHERE SPECIFIC_SCHEMA = DATABASE()
+WHERE SPECIFIC_SCHEMA = ` + cond + `
 ORDER BY SPECIFIC_NAME, ORDINAL_POSITION;`
-	rows, err := m.db.Query(query)
+	rows, err := m.db.Query(query, args...)
 	if err != nil {
-		return fmt.Errorf("failed to query routines: %w", err)
+		return nil, fmt.Errorf("failed to query routines: %w", err)
 	}
 	defer rows.Close()
 
@@ -310,10 +3512,10 @@ ORDER BY SPECIFIC_NAME, ORDINAL_POSITION;`
 		var specificName, paramName, dataType, paramMode sql.NullString
 		var ordinal sql.NullInt64
 		if err := rows.Scan(&specificName, &paramName, &dataType, &paramMode, &ordinal); err != nil {
-			return fmt.Errorf("failed to scan routine row: %w", err)
+			return nil, fmt.Errorf("failed to scan routine row: %w", err)
 		}
 		rName := specificName.String
-		rInfo, ok := m.routines[rName]
+		rInfo, ok := routines[rName]
 		if !ok {
 			rInfo = RoutineInfo{Name: rName, Params: []RoutineParam{}}
 		}
@@ -338,70 +3540,335 @@ ORDER BY SPECIFIC_NAME, ORDINAL_POSITION;`
 				})
 			}
 		}
-		m.routines[rName] = rInfo
+		routines[rName] = rInfo
 	}
-	return nil
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read routines: %w", err)
+	}
+	if len(m.replicas) > 0 {
+		if err := m.loadRoutineDataAccess(schema, routines); err != nil {
+			return nil, err
+		}
+	}
+	return routines, nil
+}
+
+// loadRoutineDataAccess records SQL_DATA_ACCESS of every routine, used to route read-only routines to replicas.
+func (m *mysqlPlugin) loadRoutineDataAccess(schema string, routines map[string]RoutineInfo) error {
+	cond, args := schemaCondition(schema)
+	rows, err := m.db.Query(`
+SELECT SPECIFIC_NAME, SQL_DATA_ACCESS
+FROM information_schema.routines
+WHERE ROUTINE_SCHEMA = `+cond+`;`, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query routine data access: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, access string
+		if err := rows.Scan(&name, &access); err != nil {
+			return fmt.Errorf("failed to scan routine data access: %w", err)
+		}
+		if rInfo, ok := routines[name]; ok {
+			rInfo.DataAccess = access
+			routines[name] = rInfo
+		}
+	}
+	return rows.Err()
 }
 
 // GetSchema enumerates tables + views and routines, building a swagger-ish schema.
-func (m *mysqlPlugin) GetSchema(ctx map[string]any) (any, error) {
-	tables, err := m.getTablesSchema()
+func (m *mysqlPlugin) GetSchema(ctx map[string]any) (_ any, err error) {
+	_, span := m.startOperation(ctx, "GetSchema", "SELECT", "information_schema")
+	defer func() { endSpan(span, err) }()
+	// Without a tenant in the context, the database of the DSN describes the layout shared by the tenants.
+	schema := ""
+	if m.tenants != nil {
+		if schema, _, err = m.tenants.lookup(ctx); err != nil {
+			return nil, err
+		}
+	}
+	tables, err := m.tablesFor(m.readDB(ctx), schema)
+	if err != nil {
+		return nil, err
+	}
+	routines, err := m.routinesFor(schema)
 	if err != nil {
 		return nil, err
 	}
-	rpc, err := m.getRPCSchema()
+	rpc, err := m.getRPCSchema(routines, "")
 	if err != nil {
 		return nil, err
 	}
+	if len(m.schemas) > 0 {
+		// The tables of a tenant schema are cached, so the listed schemas are merged into a copy.
+		tables = maps.Clone(tables)
+	}
+	for _, extra := range m.schemas {
+		extraTables, err := m.getTablesSchema(m.readDB(ctx), extra, extra)
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(tables, extraTables)
+		extraRPC, err := m.getRPCSchema(m.schemaRoutines[extra], extra)
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(rpc, extraRPC)
+	}
 	return map[string]any{
 		"tables": tables,
 		"rpc":    rpc,
 	}, nil
 }
 
-// getTablesSchema enumerates both tables and views from INFORMATION_SCHEMA.TABLES.
-func (m *mysqlPlugin) getTablesSchema() (map[string]any, error) {
+// getTablesSchema enumerates both tables and views of schema from INFORMATION_SCHEMA.TABLES.
+// They are exposed under names qualified with namespace, unless it is empty.
+func (m *mysqlPlugin) getTablesSchema(db *sql.DB, schema, namespace string) (map[string]any, error) {
 	result := make(map[string]any)
-	rows, err := m.db.Query(`
-SELECT TABLE_NAME, TABLE_TYPE
+	cond, args := schemaCondition(schema)
+	rows, err := db.Query(`
+SELECT TABLE_NAME, TABLE_TYPE, TABLE_COMMENT
 FROM INFORMATION_SCHEMA.TABLES
-WHERE TABLE_SCHEMA = DATABASE()
-`)
+WHERE TABLE_SCHEMA = `+cond+`
+`, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list tables/views: %w", err)
 	}
 	defer rows.Close()
 
 	type tblInfo struct {
-		Name string
-		Type string // "BASE TABLE" or "VIEW"
+		Name    string
+		Type    string // "BASE TABLE" or "VIEW"
+		Comment string
 	}
 	var entries []tblInfo
 	for rows.Next() {
 		var tname, ttype string
-		if err := rows.Scan(&tname, &ttype); err != nil {
+		var comment sql.NullString
+		if err := rows.Scan(&tname, &ttype, &comment); err != nil {
 			return nil, err
 		}
-		entries = append(entries, tblInfo{Name: tname, Type: ttype})
+		entries = append(entries, tblInfo{Name: tname, Type: ttype, Comment: comment.String})
+	}
+	if len(entries) == 0 {
+		return result, nil
+	}
+	foreignKeys, err := queryForeignKeys(context.Background(), db, schema)
+	if err != nil {
+		return nil, err
+	}
+	indexes, err := queryIndexes(db, schema)
+	if err != nil {
+		return nil, err
 	}
 	for _, e := range entries {
-		sch, err := m.buildTableSchema(e.Name)
+		// Dotted names are read as schema.table, so such a table cannot be reached
+		// and its key would collide with the qualified tables of the listed schemas.
+		if strings.Contains(e.Name, ".") {
+			continue
+		}
+		name := qualify(namespace, e.Name)
+		if !m.access.tableVisible(name) {
+			continue
+		}
+		sch, err := m.buildTableSchema(db, schema, e.Name, name)
 		if err != nil {
-			return nil, fmt.Errorf("failed to build schema for %s %s: %w", e.Type, e.Name, err)
+			return nil, fmt.Errorf("failed to build schema for %s %s: %w", e.Type, name, err)
+		}
+		if cfg, ok := m.softDelete[name]; ok {
+			sch["x-soft-delete"] = map[string]any{
+				"column": cfg.Column,
+				"mode":   cfg.Mode,
+			}
+		}
+		if ops := m.access.operations(name); ops != nil {
+			sch["x-operations"] = ops
+		}
+		if namespace != "" {
+			sch["x-schema"] = namespace
 		}
-		result[e.Name] = sch
+		// MySQL reports the comment of every view as "VIEW".
+		if e.Comment != "" && e.Type != "VIEW" {
+			sch["description"] = e.Comment
+		}
+		m.describeKeys(sch, name, namespace, foreignKeys[e.Name], indexes[e.Name])
+		result[name] = sch
 	}
 	return result, nil
 }
 
-// buildTableSchema queries COLUMNS for the given table/view name.
-func (m *mysqlPlugin) buildTableSchema(tableName string) (map[string]any, error) {
+// foreignKey is a foreign key constraint read from INFORMATION_SCHEMA.
+type foreignKey struct {
+	Name       string
+	Columns    []string
+	RefSchema  string
+	RefTable   string
+	RefColumns []string
+	SameSchema bool // the referenced table is in the schema of the constraint
+	OnUpdate   string
+	OnDelete   string
+}
+
+// tableIndex is an index read from INFORMATION_SCHEMA.STATISTICS.
+type tableIndex struct {
+	Name    string
+	Columns []string
+	Unique  bool
+	Type    string // BTREE, HASH, FULLTEXT or SPATIAL
+}
+
+// queryForeignKeys returns the foreign keys of the tables of schema, by table name.
+func queryForeignKeys(ctx context.Context, q queryer, schema string) (map[string][]foreignKey, error) {
+	cond, args := schemaCondition(schema)
+	rows, err := q.QueryContext(ctx, `
+SELECT k.TABLE_NAME, k.CONSTRAINT_NAME, k.COLUMN_NAME, k.REFERENCED_TABLE_SCHEMA, k.REFERENCED_TABLE_NAME,
+	k.REFERENCED_COLUMN_NAME, k.REFERENCED_TABLE_SCHEMA = k.TABLE_SCHEMA, r.UPDATE_RULE, r.DELETE_RULE
+FROM INFORMATION_SCHEMA.KEY_COLUMN_USAGE k
+JOIN INFORMATION_SCHEMA.REFERENTIAL_CONSTRAINTS r
+	ON r.CONSTRAINT_SCHEMA = k.CONSTRAINT_SCHEMA AND r.TABLE_NAME = k.TABLE_NAME AND r.CONSTRAINT_NAME = k.CONSTRAINT_NAME
+WHERE k.TABLE_SCHEMA = `+cond+` AND k.REFERENCED_TABLE_NAME IS NOT NULL
+ORDER BY k.TABLE_NAME, k.CONSTRAINT_NAME, k.ORDINAL_POSITION
+`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list foreign keys: %w", err)
+	}
+	defer rows.Close()
+	result := make(map[string][]foreignKey)
+	for rows.Next() {
+		var table, name, column, refSchema, refTable, refColumn, onUpdate, onDelete string
+		var sameSchema bool
+		if err := rows.Scan(&table, &name, &column, &refSchema, &refTable, &refColumn, &sameSchema, &onUpdate, &onDelete); err != nil {
+			return nil, err
+		}
+		keys := result[table]
+		if len(keys) == 0 || keys[len(keys)-1].Name != name {
+			keys = append(keys, foreignKey{Name: name, RefSchema: refSchema, RefTable: refTable, SameSchema: sameSchema, OnUpdate: onUpdate, OnDelete: onDelete})
+		}
+		fk := &keys[len(keys)-1]
+		fk.Columns = append(fk.Columns, column)
+		fk.RefColumns = append(fk.RefColumns, refColumn)
+		result[table] = keys
+	}
+	return result, rows.Err()
+}
+
+// queryIndexes returns the indexes of the tables of schema, by table name.
+// Functional key parts, which have no column, are left out.
+func queryIndexes(db *sql.DB, schema string) (map[string][]tableIndex, error) {
+	cond, args := schemaCondition(schema)
+	rows, err := db.Query(`
+SELECT TABLE_NAME, INDEX_NAME, NON_UNIQUE, COLUMN_NAME, INDEX_TYPE
+FROM INFORMATION_SCHEMA.STATISTICS
+WHERE TABLE_SCHEMA = `+cond+`
+ORDER BY TABLE_NAME, INDEX_NAME, SEQ_IN_INDEX
+`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list indexes: %w", err)
+	}
+	defer rows.Close()
+	result := make(map[string][]tableIndex)
+	for rows.Next() {
+		var table, name, indexType string
+		var column sql.NullString
+		var nonUnique bool
+		if err := rows.Scan(&table, &name, &nonUnique, &column, &indexType); err != nil {
+			return nil, err
+		}
+		indexes := result[table]
+		if len(indexes) == 0 || indexes[len(indexes)-1].Name != name {
+			indexes = append(indexes, tableIndex{Name: name, Unique: !nonUnique, Type: indexType})
+		}
+		if column.Valid {
+			idx := &indexes[len(indexes)-1]
+			idx.Columns = append(idx.Columns, column.String)
+		}
+		result[table] = indexes
+	}
+	return result, rows.Err()
+}
+
+// referencedSchema returns the schema of the table referenced by fk and the namespace it is exposed in,
+// given those of the table holding the constraint. ok is false when the referenced table is not exposed.
+func (m *mysqlPlugin) referencedSchema(fk foreignKey, schema, namespace string) (refSchema, refNamespace string, ok bool) {
+	switch {
+	case fk.SameSchema:
+		return schema, namespace, true
+	case slices.Contains(m.schemas, fk.RefSchema):
+		return fk.RefSchema, fk.RefSchema, true
+	case fk.RefSchema == m.dbName && m.tenants == nil:
+		return "", "", true
+	}
+	return "", "", false
+}
+
+// referencedName returns the name under which the table referenced by fk is exposed,
+// given the namespace of the table holding the constraint. ok is false when it is not exposed.
+func (m *mysqlPlugin) referencedName(fk foreignKey, namespace string) (name string, ok bool) {
+	_, refNamespace, ok := m.referencedSchema(fk, "", namespace)
+	return qualify(refNamespace, fk.RefTable), ok
+}
+
+// describeKeys adds the primary key, unique keys, indexes and foreign keys of the table exposed as name
+// to its schema as x-primary-key, x-unique-keys, x-indexes and x-foreign-keys. Keys involving hidden
+// columns and foreign keys referencing hidden or unexposed tables are left out.
+func (m *mysqlPlugin) describeKeys(sch map[string]any, name, namespace string, foreignKeys []foreignKey, indexes []tableIndex) {
+	hidden := func(table string, columns []string) bool {
+		return len(columns) == 0 || slices.ContainsFunc(columns, func(column string) bool { return m.access.columnHidden(table, column) })
+	}
+	var uniqueKeys, otherIndexes []map[string]any
+	for _, idx := range indexes {
+		if hidden(name, idx.Columns) {
+			continue
+		}
+		switch {
+		case idx.Name == "PRIMARY":
+			sch["x-primary-key"] = idx.Columns
+		case idx.Unique:
+			uniqueKeys = append(uniqueKeys, map[string]any{"name": idx.Name, "columns": idx.Columns})
+		default:
+			otherIndexes = append(otherIndexes, map[string]any{"name": idx.Name, "columns": idx.Columns, "type": idx.Type})
+		}
+	}
+	var references []map[string]any
+	for _, fk := range foreignKeys {
+		refName, exposed := m.referencedName(fk, namespace)
+		if !exposed || hidden(name, fk.Columns) || !m.access.tableVisible(refName) || hidden(refName, fk.RefColumns) {
+			continue
+		}
+		references = append(references, map[string]any{
+			"name":    fk.Name,
+			"columns": fk.Columns,
+			"references": map[string]any{
+				"table":   refName,
+				"columns": fk.RefColumns,
+			},
+			"onUpdate": fk.OnUpdate,
+			"onDelete": fk.OnDelete,
+		})
+	}
+	if uniqueKeys != nil {
+		sch["x-unique-keys"] = uniqueKeys
+	}
+	if otherIndexes != nil {
+		sch["x-indexes"] = otherIndexes
+	}
+	if references != nil {
+		sch["x-foreign-keys"] = references
+	}
+}
+
+// buildTableSchema queries COLUMNS for the given table/view name of schema, exposed as name.
+func (m *mysqlPlugin) buildTableSchema(db *sql.DB, schema, tableName, name string) (map[string]any, error) {
+	cond, args := schemaCondition(schema)
 	query := `
-SELECT COLUMN_NAME, DATA_TYPE, IS_NULLABLE, COLUMN_DEFAULT, COLUMN_KEY
+SELECT COLUMN_NAME, DATA_TYPE, IS_NULLABLE, COLUMN_DEFAULT, COLUMN_KEY,
+	COLUMN_TYPE, CHARACTER_MAXIMUM_LENGTH, NUMERIC_PRECISION, NUMERIC_SCALE, EXTRA, COLUMN_COMMENT
 FROM INFORMATION_SCHEMA.COLUMNS
-WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?
+WHERE TABLE_SCHEMA = ` + cond + ` AND TABLE_NAME = ?
 `
-	rows, err := m.db.Query(query, tableName)
+	rows, err := db.Query(query, append(args, tableName)...)
 	if err != nil {
 		return nil, err
 	}
@@ -410,65 +3877,263 @@ WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?
 	properties := make(map[string]any)
 	var required []string
 	for rows.Next() {
-		var colName, dt, nullable, defv, ckey sql.NullString
-		if err := rows.Scan(&colName, &dt, &nullable, &defv, &ckey); err != nil {
+		var colName, dt, nullable, defv, ckey, columnType, extra, comment sql.NullString
+		var maxLength, precision, scale sql.NullInt64
+		if err := rows.Scan(&colName, &dt, &nullable, &defv, &ckey,
+			&columnType, &maxLength, &precision, &scale, &extra, &comment); err != nil {
 			return nil, err
 		}
-		colType := mapMySQLType(dt.String)
-		prop := map[string]any{
-			"type": colType,
+		if m.access.columnHidden(name, colName.String) {
+			continue
+		}
+		colType, format := mapMySQLType(dt.String, columnType.String)
+		prop := map[string]any{}
+		if colType != "" {
+			prop["type"] = colType
+		}
+		if format != "" {
+			prop["format"] = format
+		}
+		switch strings.ToLower(dt.String) {
+		case "enum":
+			prop["enum"] = parseEnumValues(columnType.String)
+		case "set":
+			// A SET value is a comma-separated subset of the members, which enum cannot express.
+			prop["x-set"] = parseEnumValues(columnType.String)
+		case "time":
+			prop["pattern"] = timePattern
+		case "decimal", "numeric":
+			prop["pattern"] = decimalPattern
+			if precision.Valid {
+				prop["x-precision"] = precision.Int64
+			}
+			if scale.Valid {
+				prop["x-scale"] = scale.Int64
+			}
+		default:
+			switch {
+			case format == "byte" && maxLength.Valid && maxLength.Int64 > 0:
+				// Binary values are returned base64-encoded.
+				prop["maxLength"] = (maxLength.Int64 + 2) / 3 * 4
+			case colType == "string" && maxLength.Valid && maxLength.Int64 > 0:
+				prop["maxLength"] = maxLength.Int64
+			}
+		}
+		if colType != "string" && strings.Contains(strings.ToLower(columnType.String), "unsigned") || strings.EqualFold(dt.String, "bit") {
+			prop["minimum"] = 0
+		}
+		if def, ok := columnDefault(colType, defv, extra.String); ok {
+			if text, isText := def.(string); isText && format == "date-time" {
+				def = decodeBytes([]byte(text), "DATETIME")
+			}
+			prop["default"] = def
+		}
+		if comment.String != "" {
+			prop["description"] = comment.String
 		}
 		isPri := (strings.ToUpper(ckey.String) == "PRI")
 		if strings.ToUpper(nullable.String) == "YES" {
 			prop["x-nullable"] = true
 		}
-		if isPri {
+		if isPri || m.access.isAuditColumn(name, colName.String) {
 			// readOnly => not required
 			prop["readOnly"] = true
 		} else if strings.ToUpper(nullable.String) == "NO" && !defv.Valid {
 			required = append(required, colName.String)
 		}
 
+		if mask, ok := m.access.mask(name, colName.String, nil); ok {
+			prop["x-mask"] = mask.Mode
+		}
+
 		properties[colName.String] = prop
 	}
-	schema := map[string]any{
+	tableSchema := map[string]any{
 		"type":       "object",
 		"properties": properties,
 	}
 	if len(required) > 0 {
-		schema["required"] = required
+		tableSchema["required"] = required
 	}
-	return schema, nil
+	return tableSchema, nil
+}
+
+// Patterns of the text values of TIME and DECIMAL columns.
+const (
+	timePattern    = `^-?[0-9]{2,3}:[0-9]{2}:[0-9]{2}(\.[0-9]+)?$`
+	decimalPattern = `^-?[0-9]+(\.[0-9]+)?$`
+)
+
+// jsonType is the JSON schema type and OpenAPI format of values of a MySQL data type, as serialized by scanRows.
+type jsonType struct {
+	Type   string // empty for JSON documents, which may hold any value
+	Format string
+}
+
+// mysqlTypes maps the DATA_TYPE of MySQL 8 and MariaDB columns to their jsonType.
+// Strings are returned as they are stored and binary values base64-encoded, hence the "byte" format.
+// DECIMAL values are returned as text, since a float64 would lose digits; BIT values are decoded as integers.
+var mysqlTypes = map[string]jsonType{
+	// Integers
+	"tinyint":   {"integer", "int32"},
+	"smallint":  {"integer", "int32"},
+	"mediumint": {"integer", "int32"},
+	"int":       {"integer", "int32"},
+	"integer":   {"integer", "int32"},
+	"bigint":    {"integer", "int64"},
+	"bit":       {"integer", "int64"},
+	"year":      {"integer", ""},
+	// Fixed and floating point
+	"decimal": {"string", ""},
+	"numeric": {"string", ""},
+	"float":   {"number", "float"},
+	"double":  {"number", "double"},
+	"real":    {"number", "double"},
+	// Date and time. TIME values are durations that may be negative or exceed 24 hours, which
+	// the "time" format cannot express, so they are described by timePattern instead.
+	"date":      {"string", "date"},
+	"datetime":  {"string", "date-time"},
+	"timestamp": {"string", "date-time"},
+	"time":      {"string", ""},
+	// Text
+	"char":       {"string", ""},
+	"varchar":    {"string", ""},
+	"tinytext":   {"string", ""},
+	"text":       {"string", ""},
+	"mediumtext": {"string", ""},
+	"longtext":   {"string", ""},
+	"enum":       {"string", ""},
+	"set":        {"string", ""},
+	// Binary values are returned base64-encoded.
+	"binary":     {"string", "byte"},
+	"varbinary":  {"string", "byte"},
+	"tinyblob":   {"string", "byte"},
+	"blob":       {"string", "byte"},
+	"mediumblob": {"string", "byte"},
+	"longblob":   {"string", "byte"},
+	"vector":     {"string", "byte"},
+	// Spatial values are returned in the internal format, a 4-byte SRID followed by WKB, base64-encoded.
+	"geometry":           {"string", "byte"},
+	"point":              {"string", "byte"},
+	"linestring":         {"string", "byte"},
+	"polygon":            {"string", "byte"},
+	"multipoint":         {"string", "byte"},
+	"multilinestring":    {"string", "byte"},
+	"multipolygon":       {"string", "byte"},
+	"geometrycollection": {"string", "byte"},
+	"geomcollection":     {"string", "byte"},
+	// JSON documents are decoded into the value they hold.
+	"json": {"", ""},
+	// MariaDB
+	"inet4": {"string", "ipv4"},
+	"inet6": {"string", "ipv6"},
+	"uuid":  {"string", "uuid"},
+}
+
+// mapMySQLType returns the JSON schema type and format of the data type. columnType, the COLUMN_TYPE
+// of a column when known, refines it: TINYINT(1), which BOOLEAN stands for, is an integer of format
+// "boolean" because its values are returned as 0 and 1, and unsigned integers need a wider format.
+// Unknown types are described as strings.
+func mapMySQLType(dataType, columnType string) (typ, format string) {
+	t, ok := mysqlTypes[strings.ToLower(strings.TrimSpace(dataType))]
+	if !ok {
+		return "string", ""
+	}
+	columnType = strings.ToLower(columnType)
+	switch {
+	case strings.HasPrefix(columnType, "tinyint(1)"):
+		return t.Type, "boolean"
+	case t.Format == "int32" && strings.Contains(columnType, "unsigned"):
+		return t.Type, "int64"
+	case t.Format == "int64" && strings.Contains(columnType, "unsigned"):
+		// Values up to 2^64-1 do not fit int64.
+		return t.Type, ""
+	}
+	return t.Type, t.Format
+}
+
+// parseEnumValues returns the members of an ENUM or SET column type such as enum('a','b').
+// Quotes inside members are doubled.
+func parseEnumValues(columnType string) []string {
+	open, end := strings.Index(columnType, "("), strings.LastIndex(columnType, ")")
+	if open < 0 || end < open {
+		return nil
+	}
+	values := []string{}
+	var value strings.Builder
+	quoted := false
+	list := columnType[open+1 : end]
+	for i := 0; i < len(list); i++ {
+		c := list[i]
+		switch {
+		case c == '\'' && quoted && i+1 < len(list) && list[i+1] == '\'':
+			value.WriteByte(c)
+			i++
+		case c == '\'':
+			if quoted {
+				values = append(values, value.String())
+				value.Reset()
+			}
+			quoted = !quoted
+		case quoted:
+			value.WriteByte(c)
+		}
+	}
+	return values
 }
 
-// mapMySQLType => returns swagger-ish type for the data type.
-func mapMySQLType(dt string) string {
-	up := strings.ToUpper(dt)
-	if strings.Contains(up, "INT") {
-		return "integer"
+// columnDefault converts COLUMN_DEFAULT into a value of the schema type. Expressions such as
+// CURRENT_TIMESTAMP have no value known in advance and are left out.
+func columnDefault(colType string, defv sql.NullString, extra string) (any, bool) {
+	if !defv.Valid || strings.Contains(strings.ToUpper(extra), "DEFAULT_GENERATED") {
+		return nil, false
 	}
-	if strings.Contains(up, "CHAR") || strings.Contains(up, "TEXT") {
-		return "string"
+	def := defv.String
+	// MariaDB quotes literal string defaults and reports expressions and NULL unquoted.
+	if len(def) >= 2 && def[0] == '\'' && def[len(def)-1] == '\'' {
+		return strings.ReplaceAll(def[1:len(def)-1], "''", "'"), true
 	}
-	if strings.Contains(up, "BLOB") {
-		return "string"
+	switch colType {
+	case "integer":
+		if v, err := strconv.ParseInt(def, 10, 64); err == nil {
+			return v, true
+		}
+		return nil, false
+	case "number":
+		if v, err := strconv.ParseFloat(def, 64); err == nil {
+			return v, true
+		}
+		return nil, false
 	}
-	if strings.Contains(up, "FLOAT") || strings.Contains(up, "DOUBLE") || strings.Contains(up, "DEC") || strings.Contains(up, "REAL") {
-		return "number"
+	if strings.EqualFold(def, "NULL") || strings.HasSuffix(def, "()") || strings.HasPrefix(strings.ToUpper(def), "CURRENT_TIMESTAMP") {
+		return nil, false
 	}
-	return "string"
+	return def, true
 }
 
-// getRPCSchema uses m.routines to build routineName => [inSchema, outSchema].
-func (m *mysqlPlugin) getRPCSchema() (map[string]any, error) {
+// getRPCSchema uses routines to build routineName => [inSchema, outSchema].
+// Routine names are qualified with namespace, unless it is empty.
+func (m *mysqlPlugin) getRPCSchema(routines map[string]RoutineInfo, namespace string) (map[string]any, error) {
 	rmap := make(map[string]any)
-	for name, info := range m.routines {
+	for routine, info := range routines {
+		// Like tables, routines with dotted names cannot be called and would collide with qualified names.
+		if strings.Contains(routine, ".") {
+			continue
+		}
+		name := qualify(namespace, routine)
+		if !m.access.routineVisible(name) {
+			continue
+		}
 		inProps := make(map[string]any)
 		var inReq []string
 		for _, param := range info.Params {
-			propType := mapMySQLType(param.DataType)
-			prop := map[string]any{
-				"type": propType,
+			propType, format := mapMySQLType(param.DataType, "")
+			prop := map[string]any{}
+			if propType != "" {
+				prop["type"] = propType
+			}
+			if format != "" {
+				prop["format"] = format
 			}
 			inProps[param.Name] = prop
 			inReq = append(inReq, param.Name)
@@ -485,11 +4150,16 @@ func (m *mysqlPlugin) getRPCSchema() (map[string]any, error) {
 			"properties": map[string]any{},
 		}
 		if info.ReturnType != "" {
-			t := mapMySQLType(info.ReturnType)
+			result := map[string]any{}
+			typ, format := mapMySQLType(info.ReturnType, "")
+			if typ != "" {
+				result["type"] = typ
+			}
+			if format != "" {
+				result["format"] = format
+			}
 			outSchema["properties"] = map[string]any{
-				"result": map[string]any{
-					"type": t,
-				},
+				"result": result,
 			}
 		}
 		rmap[name] = []any{inSchema, outSchema}
@@ -498,10 +4168,22 @@ func (m *mysqlPlugin) getRPCSchema() (map[string]any, error) {
 }
 
 // CallFunction executes a stored procedure/function with final parameters.
-func (m *mysqlPlugin) CallFunction(userID, funcName string, data map[string]any, ctx map[string]any) (any, error) {
-	rInfo, ok := m.routines[funcName]
-	if !ok {
-		return nil, fmt.Errorf("routine %s not found", funcName)
+// Column masks do not apply to its results, which belong to no table.
+func (m *mysqlPlugin) CallFunction(userID, funcName string, data map[string]any, ctx map[string]any) (_ any, err error) {
+	defer m.metrics.observe("CallFunction", funcName, time.Now(), &err)
+	spanCtx, span := m.startOperation(ctx, "CallFunction", "CALL", funcName)
+	defer func() { endSpan(span, err) }()
+	schema, routine, err := m.resolve(ctx, funcName, "routine")
+	if err != nil {
+		return nil, err
+	}
+	routines, err := m.routinesFor(schema)
+	if err != nil {
+		return nil, classifyError(err)
+	}
+	rInfo, ok := routines[routine]
+	if !ok || !m.access.routineVisible(funcName) {
+		return nil, newDBError(errNotFound, fmt.Errorf("routine %s not found", funcName))
 	}
 	sort.Slice(rInfo.Params, func(i, j int) bool {
 		return rInfo.Params[i].Ordinal < rInfo.Params[j].Ordinal
@@ -512,7 +4194,7 @@ func (m *mysqlPlugin) CallFunction(userID, funcName string, data map[string]any,
 		placeholders = append(placeholders, "?")
 		val, found := data[param.Name]
 		if !found {
-			return nil, fmt.Errorf("missing required argument: %s", param.Name)
+			return nil, newDBError(errValidation, fmt.Errorf("missing required argument: %s", param.Name))
 		}
 		callArgs = append(callArgs, val)
 	}
@@ -526,50 +4208,132 @@ func (m *mysqlPlugin) CallFunction(userID, funcName string, data map[string]any,
 			}
 		}
 		if !found {
-			return nil, fmt.Errorf("unexpected argument: %s", k)
+			return nil, newDBError(errValidation, fmt.Errorf("unexpected argument: %s", k))
 		}
 	}
 	var callQuery string
 	if rInfo.ReturnType != "" {
-		callQuery = fmt.Sprintf("SELECT %s(%s) AS result", funcName, strings.Join(placeholders, ", "))
+		callQuery = fmt.Sprintf("SELECT %s(%s) AS result", quoteQualified(schema, routine), strings.Join(placeholders, ", "))
 	} else {
-		callQuery = fmt.Sprintf("CALL %s(%s)", funcName, strings.Join(placeholders, ", "))
+		callQuery = fmt.Sprintf("CALL %s(%s)", quoteQualified(schema, routine), strings.Join(placeholders, ", "))
+	}
+
+	// Routines that only read data may run on a replica.
+	db := m.db
+	if rInfo.DataAccess == "READS SQL DATA" {
+		db = m.readDB(ctx)
 	}
 
 	// Use handleTransaction for managing the transaction and context
-	res, err := m.handleTransaction(ctx, func(tx *sql.Tx) (any, error) {
-		rows, err := tx.QueryContext(context.Background(), callQuery, callArgs...)
+	res, err := m.handleTransactionOn(spanCtx, db, ctx, func(txCtx context.Context, tx *sql.Tx) (any, error) {
+		start := time.Now()
+		queryCtx, span := m.startSpan(txCtx, "query", trace.WithAttributes(semconv.DBQueryText(callQuery)))
+		rows, err := tx.QueryContext(queryCtx, callQuery, callArgs...)
+		endSpan(span, err)
 		if err != nil {
+			m.slowLog.log("CallFunction", funcName, callQuery, callArgs, start, 0, err)
 			// Error during query execution, transaction will be rolled back by handleTransaction
 			return nil, fmt.Errorf("failed to call routine: %w", err)
 		}
-		defer rows.Close()
-		result, err := scanRows(rows)
-		if err != nil {
-			// Error during scanning, transaction will be rolled back by handleTransaction
-			return nil, fmt.Errorf("failed to scan routine result: %w", err)
+		defer rows.Close()
+		result, err := m.scanRows(txCtx, rows)
+		m.slowLog.log("CallFunction", funcName, callQuery, callArgs, start, int64(len(result)), err)
+		if err != nil {
+			// Error during scanning, transaction will be rolled back by handleTransaction
+			return nil, fmt.Errorf("failed to scan routine result: %w", err)
+		}
+		// Return the scanned result. Commit/Rollback is handled by handleTransaction.
+		return result, nil
+	})
+
+	if err != nil {
+		return nil, err // Error already includes context from handleTransaction or the operation
+	}
+
+	// Return the result obtained from handleTransaction
+	return res, nil
+}
+
+// handleTransaction manages the transaction lifecycle including context injection and conditional commit/rollback.
+// Transactions failing with a deadlock or lock wait timeout are re-run from scratch with exponential backoff,
+// bounded by maxRetries and the plugin timeout. Transactions that lost the primary before COMMIT
+// are replayed once the failover connector finds the new primary.
+func (m *mysqlPlugin) handleTransaction(ctx context.Context, ctxMap map[string]any, operation func(ctx context.Context, tx *sql.Tx) (any, error)) (any, error) {
+	return m.handleTransactionOn(ctx, m.db, ctxMap, operation)
+}
+
+// handleTransactionOn is handleTransaction running against the given pool.
+func (m *mysqlPlugin) handleTransactionOn(ctx context.Context, db *sql.DB, ctxMap map[string]any, operation func(ctx context.Context, tx *sql.Tx) (any, error)) (any, error) {
+	txOpts, err := m.txOptions(ctxMap)
+	if err != nil {
+		return nil, err
+	}
+
+	var deadline time.Time
+	if m.defaultTimeout > 0 {
+		deadline = time.Now().Add(m.defaultTimeout)
+	}
+	retries, failovers := 0, 0
+	for {
+		result, err := m.runTransaction(ctx, db, ctxMap, txOpts, operation)
+		// Nothing was committed, so the transaction can be replayed on the new primary.
+		if err != nil && m.shouldFailover(db, err) && failovers < len(m.failover.hosts) {
+			m.resetPrimaryPool(err)
+			time.Sleep(retryDelay(m.retryBackoff, failovers))
+			failovers++
+			continue
+		}
+		if err == nil || !isRetryableError(err) {
+			return result, classifyError(err)
+		}
+		if retries >= m.maxRetries {
+			if retries > 0 {
+				return nil, classifyError(fmt.Errorf("%w (gave up after %d retries)", err, retries))
+			}
+			return nil, classifyError(err)
+		}
+		delay := retryDelay(m.retryBackoff, retries)
+		if !deadline.IsZero() && time.Now().Add(delay).After(deadline) {
+			return nil, classifyError(fmt.Errorf("%w (retry deadline exceeded after %d retries)", err, retries))
 		}
-		// Return the scanned result. Commit/Rollback is handled by handleTransaction.
-		return result, nil
-	})
+		retries++
+		m.metrics.retry(err)
+		m.log().Warn("retrying transaction", "delay", delay.String(), "retry", retries, "max_retries", m.maxRetries, "error", err.Error())
+		time.Sleep(delay)
+	}
+}
 
-	if err != nil {
-		return nil, err // Error already includes context from handleTransaction or the operation
+// isRetryableError reports whether err is a MySQL deadlock or lock wait timeout,
+// after which the whole transaction can safely be re-run.
+func isRetryableError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return false
 	}
+	return mysqlErr.Number == 1213 || mysqlErr.Number == 1205
+}
 
-	// Return the result obtained from handleTransaction
-	return res, nil
+// retryDelay returns the exponential backoff for the given attempt with up to 50% random jitter.
+func retryDelay(base time.Duration, attempt int) time.Duration {
+	delay := base << attempt
+	if delay <= 0 {
+		return 0
+	}
+	half := delay / 2
+	return half + rand.N(delay-half+1)
 }
 
-// handleTransaction manages the transaction lifecycle including context injection and conditional commit/rollback.
-func (m *mysqlPlugin) handleTransaction(ctxMap map[string]any, operation func(tx *sql.Tx) (any, error)) (any, error) {
-	conn, err := m.db.Conn(context.Background())
+// runTransaction executes a single attempt of operation within a new transaction.
+func (m *mysqlPlugin) runTransaction(ctx context.Context, db *sql.DB, ctxMap map[string]any, txOpts *sql.TxOptions, operation func(ctx context.Context, tx *sql.Tx) (any, error)) (any, error) {
+	_, span := m.startSpan(ctx, "acquire connection")
+	conn, err := db.Conn(ctx)
+	endSpan(span, err)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get connection: %w", err)
 	}
 	defer conn.Close()
 
-	tx, err := conn.BeginTx(context.Background(), nil)
+	tx, err := conn.BeginTx(ctx, txOpts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to begin tx: %w", err)
 	}
@@ -584,22 +4348,31 @@ func (m *mysqlPlugin) handleTransaction(ctxMap map[string]any, operation func(tx
 		}
 
 		// Inject context *after* validating preference, but before the main operation
-		if err := m.injectContext(conn, ctxMap); err != nil {
+		_, span := m.startSpan(ctx, "inject context")
+		err := m.injectContext(conn, ctxMap)
+		endSpan(span, err)
+		if err != nil {
 			tx.Rollback() // Rollback on injection error
+			m.metrics.transaction(false)
 			return nil, fmt.Errorf("failed to inject context: %w", err)
 		}
 	}
 
 	// Execute the core operation
-	result, err := operation(tx)
+	result, err := operation(ctx, tx)
 	if err != nil {
-		tx.Rollback()   // Rollback on operation error
+		tx.Rollback() // Rollback on operation error
+		m.metrics.transaction(false)
 		return nil, err // Return the original error from the operation
 	}
 
 	// Commit or Rollback based on preference
 	if txPreference == "rollback" {
-		if err := tx.Rollback(); err != nil {
+		m.metrics.transaction(false)
+		_, span := m.startSpan(ctx, "rollback")
+		err := tx.Rollback()
+		endSpan(span, err)
+		if err != nil {
 			// Even rollback can fail, though it's less critical than a failed commit
 			return nil, fmt.Errorf("failed to rollback transaction: %w", err)
 		}
@@ -615,17 +4388,22 @@ func (m *mysqlPlugin) handleTransaction(ctxMap map[string]any, operation func(tx
 			return res, nil
 		}
 	} else { // commit or default
-		if err := tx.Commit(); err != nil {
+		_, span := m.startSpan(ctx, "commit")
+		err := tx.Commit()
+		endSpan(span, err)
+		if err != nil {
 			// Attempt rollback if commit fails, but return the commit error
+			m.metrics.transaction(false)
 			rbErr := tx.Rollback()
 			if rbErr != nil {
-				return nil, fmt.Errorf("failed to commit transaction: %w (rollback also failed: %v)", err, rbErr)
+				return nil, &commitError{fmt.Errorf("failed to commit transaction: %w (rollback also failed: %v)", err, rbErr)}
 			}
-			return nil, fmt.Errorf("failed to commit transaction: %w", err)
+			return nil, &commitError{fmt.Errorf("failed to commit transaction: %w", err)}
 		}
 	}
 
 	// Return the original result from the operation if committed successfully
+	m.metrics.transaction(true)
 	return result, nil
 }
 
@@ -681,25 +4459,437 @@ func convertILIKEtoLower(where map[string]any) map[string]any {
 	return result
 }
 
+// embed is a related resource requested in the select list of TableGet, e.g. customer(id,name).
+type embed struct {
+	alias    string   // key of the resource in result rows
+	relation string   // related table, foreign key constraint, or foreign key column without _id
+	fields   []string // columns, * or nested embeds
+	expr     string   // the select field it was parsed from
+}
+
+// embeddedTable is an embed resolved to a table, kept to mask the nested rows of the result.
+type embeddedTable struct {
+	alias    string
+	table    string // exposed name
+	children []embeddedTable
+}
+
+// relation joins a table to a related one: related.refColumns = table.columns.
+type relation struct {
+	many       bool   // rows of the related table reference the table; otherwise the table references one row
+	schema     string // schema of the related table, empty for the database of the DSN
+	namespace  string // namespace the related table is exposed in
+	table      string
+	columns    []string
+	refColumns []string
+}
+
+// relationCache holds the foreign keys of each schema and the columns of embedded tables for relationCacheTTL.
+type relationCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]relationEntry
+	columns map[string]columnsEntry // by schema and table
+}
+
+type relationEntry struct {
+	keys map[string][]foreignKey
+	at   time.Time
+}
+
+type columnsEntry struct {
+	names []string
+	at    time.Time
+}
+
+func newRelationCache(ttl time.Duration) *relationCache {
+	return &relationCache{ttl: ttl, entries: make(map[string]relationEntry), columns: make(map[string]columnsEntry)}
+}
+
+var reEmbed = regexp.MustCompile(`(?is)^(?:([A-Za-z0-9_$]+)\s*:\s*)?([A-Za-z0-9_$.]+)\s*\((.*)\)(?:\s+AS\s+([A-Za-z0-9_$]+))?$`)
+
+// joinSelectFields rejoins select fields that were split at commas inside parentheses,
+// so that customer(id,name) arrives as one field.
+func joinSelectFields(fields []string) []string {
+	var result []string
+	depth := 0
+	for _, field := range fields {
+		if depth > 0 {
+			result[len(result)-1] += "," + field
+		} else {
+			result = append(result, field)
+		}
+		depth += strings.Count(field, "(") - strings.Count(field, ")")
+	}
+	return result
+}
+
+// splitTopLevel splits s at the commas that are not inside parentheses.
+func splitTopLevel(s string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, strings.TrimSpace(s[start:]))
+}
+
+// parseEmbed parses a select field of the form [alias:]relation(field,...) [AS alias], where each
+// field is a column, * or another embed. Other fields, such as expressions, are not embeds.
+func parseEmbed(field string) (*embed, bool) {
+	match := reEmbed.FindStringSubmatch(strings.TrimSpace(field))
+	if match == nil {
+		return nil, false
+	}
+	e := &embed{alias: cmp.Or(match[1], match[4], match[2]), relation: match[2], expr: field}
+	for _, f := range splitTopLevel(match[3]) {
+		if _, nested := parseEmbed(f); f != "*" && !reColumnName.MatchString(f) && !nested {
+			return nil, false
+		}
+		e.fields = append(e.fields, f)
+	}
+	return e, true
+}
+
+// foreignKeysOf returns the foreign keys of the tables of schema, cached for relationCacheTTL.
+func (m *mysqlPlugin) foreignKeysOf(ctx context.Context, db *sql.DB, schema string) (map[string][]foreignKey, error) {
+	c := m.relations
+	if c != nil {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if entry, ok := c.entries[schema]; ok && time.Since(entry.at) < c.ttl {
+			return entry.keys, nil
+		}
+	}
+	keys, err := queryForeignKeys(ctx, db, schema)
+	if err != nil {
+		return nil, err
+	}
+	if c != nil {
+		c.entries[schema] = relationEntry{keys: keys, at: time.Now()}
+	}
+	return keys, nil
+}
+
+// findRelation looks up the relation named name of table object of schema, exposed in namespace.
+// found is false when no foreign key matches; a name matching several is an error.
+func (m *mysqlPlugin) findRelation(ctx context.Context, db *sql.DB, schema, namespace, object, name string) (rel relation, found bool, err error) {
+	keys, err := m.foreignKeysOf(ctx, db, schema)
+	if err != nil {
+		return relation{}, false, err
+	}
+	var matches []relation
+	for _, fk := range keys[object] {
+		relSchema, relNamespace, exposed := m.referencedSchema(fk, schema, namespace)
+		if !exposed {
+			continue
+		}
+		stem, isKey := strings.CutSuffix(fk.Columns[0], "_id")
+		if name == qualify(relNamespace, fk.RefTable) || name == fk.Name || (len(fk.Columns) == 1 && isKey && name == stem) {
+			matches = append(matches, relation{schema: relSchema, namespace: relNamespace, table: fk.RefTable, columns: fk.Columns, refColumns: fk.RefColumns})
+		}
+	}
+	for table, fks := range keys {
+		for _, fk := range fks {
+			if !fk.SameSchema || fk.RefTable != object {
+				continue
+			}
+			if name == qualify(namespace, table) || name == fk.Name {
+				matches = append(matches, relation{many: true, schema: schema, namespace: namespace, table: table, columns: fk.RefColumns, refColumns: fk.Columns})
+			}
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return relation{}, false, nil
+	case 1:
+		return matches[0], true, nil
+	}
+	return relation{}, false, newDBError(errValidation, fmt.Errorf("relation %s of table %s is ambiguous, use the name of its foreign key", name, qualify(namespace, object)))
+}
+
+// visibleColumns returns the columns of table of schema, exposed as name, that are not hidden.
+// Column lists are cached for relationCacheTTL.
+func (m *mysqlPlugin) visibleColumns(ctx context.Context, db *sql.DB, schema, table, name string) ([]string, error) {
+	columns, err := m.columnsOf(ctx, db, schema, table, name)
+	if err != nil {
+		return nil, err
+	}
+	var visible []string
+	for _, column := range columns {
+		if !m.access.columnHidden(name, column) {
+			visible = append(visible, column)
+		}
+	}
+	return visible, nil
+}
+
+// columnsOf returns the columns of table of schema in ordinal order, cached for relationCacheTTL.
+func (m *mysqlPlugin) columnsOf(ctx context.Context, db *sql.DB, schema, table, name string) ([]string, error) {
+	c := m.relations
+	key := schema + "." + table
+	if c != nil {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if entry, ok := c.columns[key]; ok && time.Since(entry.at) < c.ttl {
+			return entry.names, nil
+		}
+	}
+	cond, args := schemaCondition(schema)
+	rows, err := db.QueryContext(ctx, `
+SELECT COLUMN_NAME
+FROM INFORMATION_SCHEMA.COLUMNS
+WHERE TABLE_SCHEMA = `+cond+` AND TABLE_NAME = ?
+ORDER BY ORDINAL_POSITION
+`, append(args, table)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list columns of %s: %w", name, err)
+	}
+	defer rows.Close()
+	var columns []string
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if c != nil {
+		c.columns[key] = columnsEntry{names: columns, at: time.Now()}
+	}
+	return columns, nil
+}
+
+// embedSubquery builds the subquery returning the resource e related to parent through rel:
+// a JSON object for a referenced row, or a JSON array of the referencing rows. Bound values are
+// appended to args in the order of the SQL text.
+func (m *mysqlPlugin) embedSubquery(ctx context.Context, db *sql.DB, reqCtx map[string]any, e *embed, rel relation, parent string, depth int, args *[]any) (string, embeddedTable, error) {
+	name := qualify(rel.namespace, rel.table)
+	resolved := embeddedTable{alias: e.alias, table: name}
+	if depth > m.maxEmbedDepth {
+		return "", resolved, newDBError(errValidation, fmt.Errorf("embedding %s exceeds the nesting limit of %d", e.alias, m.maxEmbedDepth))
+	}
+	if err := m.access.checkTable(name, opSelect); err != nil {
+		return "", resolved, err
+	}
+	alias := fmt.Sprintf("_e%d", depth)
+	var pairs []string
+	for _, field := range e.fields {
+		if child, ok := parseEmbed(field); ok {
+			childRel, found, err := m.findRelation(ctx, db, rel.schema, rel.namespace, rel.table, child.relation)
+			if err != nil {
+				return "", resolved, err
+			}
+			if !found {
+				return "", resolved, newDBError(errValidation, fmt.Errorf("table %s has no relation %s", name, child.relation))
+			}
+			sub, childTable, err := m.embedSubquery(ctx, db, reqCtx, child, childRel, alias, depth+1, args)
+			if err != nil {
+				return "", resolved, err
+			}
+			pairs = append(pairs, fmt.Sprintf("%s, %s", quoteString(child.alias), sub))
+			resolved.children = append(resolved.children, childTable)
+			continue
+		}
+		columns := []string{field}
+		if field == "*" {
+			var err error
+			if columns, err = m.visibleColumns(ctx, db, rel.schema, rel.table, name); err != nil {
+				return "", resolved, err
+			}
+		} else if err := m.access.checkColumns(name, field); err != nil {
+			return "", resolved, err
+		}
+		for _, column := range columns {
+			pairs = append(pairs, fmt.Sprintf("%s, %s.%s", quoteString(column), alias, quoteIdentifier(column)))
+		}
+	}
+
+	var conds []string
+	for i, column := range rel.columns {
+		conds = append(conds, fmt.Sprintf("%s.%s = %s.%s", alias, quoteIdentifier(rel.refColumns[i]), parent, quoteIdentifier(column)))
+	}
+	if cfg, ok := m.softDelete[name]; ok && getPreference(reqCtx, "include_deleted") != "true" {
+		conds = append(conds, cfg.activeCondition(alias))
+	}
+	policyCond, policyArgs, err := m.access.policyCondition(name, alias, opSelect, reqCtx)
+	if err != nil {
+		return "", resolved, err
+	}
+	if policyCond != "" {
+		conds = append(conds, policyCond)
+		*args = append(*args, policyArgs...)
+	}
+	where := " WHERE " + strings.Join(conds, " AND ")
+
+	object := "JSON_OBJECT(" + strings.Join(pairs, ", ") + ")"
+	from := " FROM " + quoteQualified(rel.schema, rel.table) + " " + alias
+	if rel.many {
+		return "(SELECT COALESCE(JSON_ARRAYAGG(" + object + "), JSON_ARRAY())" + from + where + ")", resolved, nil
+	}
+	return "(SELECT " + object + from + where + " LIMIT 1)", resolved, nil
+}
+
+// selectEmbeds replaces the embeds in the select fields of table object of schema with subqueries.
+// It returns the remaining plain fields, the select list, the values bound in it and the resolved embeds.
+// Parenthesized fields that name no relation, such as count(*), are kept as they are.
+func (m *mysqlPlugin) selectEmbeds(ctx context.Context, reqCtx map[string]any, schema, object, table string, selectFields []string) (plain, fields []string, args []any, embedded []embeddedTable, err error) {
+	if m.maxEmbedDepth == 0 {
+		return selectFields, selectFields, nil, nil, nil
+	}
+	namespace := ""
+	if slices.Contains(m.schemas, schema) {
+		namespace = schema
+	}
+	db := m.readDB(reqCtx)
+	for _, field := range joinSelectFields(selectFields) {
+		e, ok := parseEmbed(field)
+		if !ok {
+			plain = append(plain, field)
+			fields = append(fields, field)
+			continue
+		}
+		rel, found, err := m.findRelation(ctx, db, schema, namespace, object, e.relation)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		if !found {
+			plain = append(plain, field)
+			fields = append(fields, field)
+			continue
+		}
+		if !reColumnName.MatchString(e.alias) {
+			return nil, nil, nil, nil, newDBError(errValidation, fmt.Errorf("invalid alias of %s", e.expr))
+		}
+		sub, resolved, err := m.embedSubquery(ctx, db, reqCtx, e, rel, quoteQualified(schema, object), 1, &args)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		fields = append(fields, sub+" AS "+e.alias)
+		embedded = append(embedded, resolved)
+	}
+	return plain, fields, args, embedded, nil
+}
+
+// decodeEmbedded decodes embedded resources returned as text rather than JSON, as MariaDB,
+// which has no JSON type, does for JSON_OBJECT and JSON_ARRAYAGG results.
+func decodeEmbedded(embedded []embeddedTable, rows []map[string]any) {
+	for _, e := range embedded {
+		var nested []map[string]any
+		for _, row := range rows {
+			if text, ok := row[e.alias].(string); ok {
+				var v any
+				if err := json.Unmarshal([]byte(text), &v); err == nil {
+					row[e.alias] = v
+				}
+			}
+			switch v := row[e.alias].(type) {
+			case map[string]any:
+				nested = append(nested, v)
+			case []any:
+				for _, item := range v {
+					if obj, ok := item.(map[string]any); ok {
+						nested = append(nested, obj)
+					}
+				}
+			}
+		}
+		decodeEmbedded(e.children, nested)
+	}
+}
+
+// maskEmbedded masks the columns of embedded resources in result rows, as maskRows does for the table.
+func (r *accessRules) maskEmbedded(ctx map[string]any, embedded []embeddedTable, rows []map[string]any) {
+	if r == nil || len(r.Masks) == 0 {
+		return
+	}
+	for _, e := range embedded {
+		var nested []map[string]any
+		for _, row := range rows {
+			switch v := row[e.alias].(type) {
+			case map[string]any:
+				nested = append(nested, v)
+			case []any:
+				for _, item := range v {
+					if obj, ok := item.(map[string]any); ok {
+						nested = append(nested, obj)
+					}
+				}
+			}
+		}
+		r.maskRows(e.table, ctx, nested)
+		r.maskEmbedded(ctx, e.children, nested)
+	}
+}
+
 // TableGet builds and executes a SELECT query.
 func (m *mysqlPlugin) TableGet(userID, table string, selectFields []string, where map[string]any,
-	ordering []string, groupBy []string, limit, offset int, ctx map[string]any) ([]map[string]any, error) {
+	ordering []string, groupBy []string, limit, offset int, ctx map[string]any) (_ []map[string]any, err error) {
+	defer m.metrics.observe("TableGet", table, time.Now(), &err)
+	spanCtx, span := m.startOperation(ctx, "TableGet", "SELECT", table)
+	defer func() { endSpan(span, err) }()
+	if err := m.access.checkTable(table, opSelect); err != nil {
+		return nil, err
+	}
+	schema, object, err := m.resolve(ctx, table, "table")
+	if err != nil {
+		return nil, err
+	}
+	plainFields, fields, embedArgs, embedded, err := m.selectEmbeds(spanCtx, ctx, schema, object, table, selectFields)
+	if err != nil {
+		return nil, classifyError(err)
+	}
+	if err := m.access.checkColumns(table, slices.Concat(plainFields, keysOf(where), ordering, groupBy)...); err != nil {
+		return nil, err
+	}
+	if err := m.access.checkMasked(table, ctx, plainFields, slices.Concat(keysOf(where), ordering, groupBy)...); err != nil {
+		return nil, err
+	}
 
 	var query strings.Builder
 	query.WriteString("SELECT ")
-	if len(selectFields) > 0 {
-		query.WriteString(strings.Join(selectFields, ", "))
+	if len(fields) > 0 {
+		query.WriteString(strings.Join(fields, ", "))
 	} else {
 		query.WriteString("*")
 	}
 	query.WriteString(" FROM ")
-	query.WriteString(table)
+	query.WriteString(quoteQualified(schema, object))
 
 	processedWhere := convertILIKEtoLower(where)
-	whereClause, args, err := easyrest.BuildWhereClauseSorted(processedWhere)
+	whereClause, whereArgs, err := easyrest.BuildWhereClauseSorted(processedWhere)
+	if err != nil {
+		return nil, newDBError(errValidation, fmt.Errorf("failed to build WHERE: %w", err))
+	}
+	// Values bound in embedded subqueries precede those of the WHERE clause.
+	args := append(embedArgs, whereArgs...)
+	var conds []string
+	// Hide soft-deleted rows unless the request explicitly asks for them.
+	if cfg, ok := m.softDelete[table]; ok && getPreference(ctx, "include_deleted") != "true" {
+		conds = append(conds, cfg.activeCondition(""))
+	}
+	policyCond, policyArgs, err := m.access.policyCondition(table, "", opSelect, ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to build WHERE: %w", err)
+		return nil, err
+	}
+	if policyCond != "" {
+		conds = append(conds, policyCond)
+		args = append(args, policyArgs...)
 	}
+	whereClause = appendCondition(whereClause, conds...)
 	query.WriteString(whereClause)
 	if len(groupBy) > 0 {
 		query.WriteString(" GROUP BY ")
@@ -718,31 +4908,133 @@ func (m *mysqlPlugin) TableGet(userID, table string, selectFields []string, wher
 		query.WriteString(strconv.Itoa(offset))
 	}
 
-	queryCtx := context.Background()
+	snapshot, err := m.useReadSnapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// The isolation preference is validated even when it is not used.
+	txOpts, err := m.txOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !snapshot {
+		txOpts = nil
+	}
 
-	conn, err := m.db.Conn(queryCtx)
+	explain, err := m.explainRequested(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get connection: %w", err)
+		return nil, err
+	}
+	if explain {
+		// The plan is read outside any snapshot: EXPLAIN does not read table data.
+		results, _, err := m.runQuery(spanCtx, ctx, table, "EXPLAIN FORMAT=JSON "+query.String(), args, nil)
+		if err != nil {
+			return nil, classifyError(err)
+		}
+		return []map[string]any{{"query": query.String(), "args": args, "plan": planOf(results)}}, nil
+	}
+
+	results, db, err := m.runQuery(spanCtx, ctx, table, query.String(), args, txOpts)
+	if err != nil && m.shouldFailover(db, err) {
+		// Reads are idempotent, so they are simply repeated on a fresh connection.
+		m.resetPrimaryPool(err)
+		results, _, err = m.runQuery(spanCtx, ctx, table, query.String(), args, txOpts)
+	}
+	if err != nil {
+		return nil, classifyError(err)
+	}
+	m.access.stripColumns(table, results)
+	m.access.maskRows(table, ctx, results)
+	decodeEmbedded(embedded, results)
+	m.access.maskEmbedded(ctx, embedded, results)
+	return results, nil
+}
+
+// runQuery executes a SELECT on a read connection after injecting the context.
+// A non-nil txOpts wraps the query in a read-only consistent snapshot.
+// It also returns the pool the query ran on, so callers can tell primary failures from replica ones.
+func (m *mysqlPlugin) runQuery(queryCtx context.Context, ctx map[string]any, table, query string, args []any, txOpts *sql.TxOptions) (results []map[string]any, db *sql.DB, err error) {
+	_, span := m.startSpan(queryCtx, "acquire connection")
+	conn, db, err := m.readConn(queryCtx, ctx)
+	endSpan(span, err)
+	if err != nil {
+		return nil, db, fmt.Errorf("failed to get connection: %w", err)
 	}
 	defer conn.Close()
 	if ctx != nil {
-		if err := m.injectContext(conn, ctx); err != nil {
-			return nil, err
+		_, span := m.startSpan(queryCtx, "inject context")
+		err := m.injectContext(conn, ctx)
+		endSpan(span, err)
+		if err != nil {
+			return nil, db, err
 		}
 	}
-	rows, err := conn.QueryContext(queryCtx, query.String(), args...)
+	if txOpts != nil {
+		if err := beginReadSnapshot(queryCtx, conn, txOpts.Isolation); err != nil {
+			return nil, db, err
+		}
+		// Nothing is written inside the snapshot, so COMMIT only releases it,
+		// but a failure still means the connection is in an unknown state.
+		defer func() {
+			if _, commitErr := conn.ExecContext(queryCtx, "COMMIT"); commitErr != nil && err == nil {
+				results, err = nil, fmt.Errorf("failed to release read snapshot: %w", commitErr)
+			}
+		}()
+	}
+	start := time.Now()
+	spanCtx, span := m.startSpan(queryCtx, "query", trace.WithAttributes(semconv.DBQueryText(query)))
+	rows, err := conn.QueryContext(spanCtx, query, args...)
+	endSpan(span, err)
 	if err != nil {
-		return nil, fmt.Errorf("failed to execute query: %w", err)
+		m.slowLog.log("TableGet", table, query, args, start, 0, err)
+		return nil, db, fmt.Errorf("failed to execute query: %w", err)
 	}
 	defer rows.Close()
-	return scanRows(rows)
+	results, err = m.scanRows(queryCtx, rows)
+	m.slowLog.log("TableGet", table, query, args, start, int64(len(results)), err)
+	return results, db, err
+}
+
+// scanRows is the package-level scanRows recorded as a "scan" span.
+func (m *mysqlPlugin) scanRows(ctx context.Context, rows *sql.Rows) ([]map[string]any, error) {
+	_, span := m.startSpan(ctx, "scan")
+	results, err := scanRows(rows)
+	span.SetAttributes(attribute.Int("db.response.returned_rows", len(results)))
+	endSpan(span, err)
+	return results, err
 }
 
 // TableCreate builds and executes an INSERT statement from data.
-func (m *mysqlPlugin) TableCreate(userID, table string, data []map[string]any, ctx map[string]any) ([]map[string]any, error) {
-	res, err := m.handleTransaction(ctx, func(tx *sql.Tx) (any, error) {
+func (m *mysqlPlugin) TableCreate(userID, table string, data []map[string]any, ctx map[string]any) (_ []map[string]any, err error) {
+	defer m.metrics.observe("TableCreate", table, time.Now(), &err)
+	spanCtx, span := m.startOperation(ctx, "TableCreate", "INSERT", table)
+	defer func() { endSpan(span, err) }()
+	if err := m.access.checkTable(table, opInsert); err != nil {
+		return nil, err
+	}
+	for _, row := range data {
+		if err := m.access.checkColumns(table, keysOf(row)...); err != nil {
+			return nil, err
+		}
+	}
+	if data, err = m.access.applyAuditColumns(table, opInsert, ctx, data); err != nil {
+		return nil, err
+	}
+	if err := m.access.checkPolicyRows(table, opInsert, ctx, data...); err != nil {
+		return nil, err
+	}
+	schema, object, err := m.resolve(ctx, table, "table")
+	if err != nil {
+		return nil, err
+	}
+	target, ref := qualify(schema, object), quoteQualified(schema, object)
+	res, err := m.handleTransaction(spanCtx, ctx, func(txCtx context.Context, tx *sql.Tx) (any, error) {
 		var results []map[string]any
-		queryCtx := context.Background()
+		var entries []auditEntry
+		key, err := m.audit.primaryKey(txCtx, tx, schema, object)
+		if err != nil {
+			return nil, err
+		}
 		for _, row := range data {
 			var cols []string
 			var placeholders []string
@@ -757,13 +5049,29 @@ func (m *mysqlPlugin) TableCreate(userID, table string, data []map[string]any, c
 				placeholders = append(placeholders, "?")
 				args = append(args, row[k])
 			}
-			insertQ := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table, strings.Join(cols, ", "), strings.Join(placeholders, ", "))
-			if _, err := tx.ExecContext(queryCtx, insertQ, args...); err != nil {
+			insertQ := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", ref, strings.Join(cols, ", "), strings.Join(placeholders, ", "))
+			start := time.Now()
+			queryCtx, span := m.startSpan(txCtx, "query", trace.WithAttributes(semconv.DBQueryText(insertQ)))
+			sqlRes, err := tx.ExecContext(queryCtx, insertQ, args...)
+			endSpan(span, err)
+			m.slowLog.log("TableCreate", table, insertQ, args, start, rowsAffected(sqlRes), err)
+			if err != nil {
 				// Error occurs within the loop, transaction will be rolled back by handleTransaction
 				return nil, fmt.Errorf("failed to execute insert: %w", err)
 			}
 			// Append the original input row to results. This is returned even on rollback.
 			results = append(results, row)
+			if m.audit != nil {
+				id, _ := sqlRes.LastInsertId()
+				after, err := m.audit.insertedImage(txCtx, tx, ref, key, row, id)
+				if err != nil {
+					return nil, err
+				}
+				entries = append(entries, auditEntry{After: after})
+			}
+		}
+		if err := m.audit.write(txCtx, tx, userID, opInsert, target, ctx, entries); err != nil {
+			return nil, err
 		}
 		// Return the collected input data.
 		return results, nil
@@ -782,8 +5090,42 @@ func (m *mysqlPlugin) TableCreate(userID, table string, data []map[string]any, c
 }
 
 // TableUpdate builds and executes an UPDATE statement.
-func (m *mysqlPlugin) TableUpdate(userID, table string, data map[string]any, where map[string]any, ctx map[string]any) (int, error) {
-	res, err := m.handleTransaction(ctx, func(tx *sql.Tx) (any, error) {
+// With the "explain" preference the statement is not executed and its plan is returned as a query_plan error.
+func (m *mysqlPlugin) TableUpdate(userID, table string, data map[string]any, where map[string]any, ctx map[string]any) (_ int, err error) {
+	defer m.metrics.observe("TableUpdate", table, time.Now(), &err)
+	spanCtx, span := m.startOperation(ctx, "TableUpdate", "UPDATE", table)
+	defer func() { endSpan(span, err) }()
+	if err := m.access.checkTable(table, opUpdate); err != nil {
+		return 0, err
+	}
+	if err := m.access.checkColumns(table, slices.Concat(keysOf(data), keysOf(where))...); err != nil {
+		return 0, err
+	}
+	if err := m.access.checkMasked(table, ctx, nil, keysOf(where)...); err != nil {
+		return 0, err
+	}
+	rows, err := m.access.applyAuditColumns(table, opUpdate, ctx, []map[string]any{data})
+	if err != nil {
+		return 0, err
+	}
+	data = rows[0]
+	if err := m.access.checkPolicyRows(table, opUpdate, ctx, data); err != nil {
+		return 0, err
+	}
+	policyCond, policyArgs, err := m.access.policyCondition(table, "", opUpdate, ctx)
+	if err != nil {
+		return 0, err
+	}
+	schema, object, err := m.resolve(ctx, table, "table")
+	if err != nil {
+		return 0, err
+	}
+	target, ref := qualify(schema, object), quoteQualified(schema, object)
+	explain, err := m.explainRequested(ctx)
+	if err != nil {
+		return 0, err
+	}
+	res, err := m.handleTransaction(spanCtx, ctx, func(txCtx context.Context, tx *sql.Tx) (any, error) {
 		var keys []string
 		for k := range data {
 			keys = append(keys, k)
@@ -795,16 +5137,39 @@ func (m *mysqlPlugin) TableUpdate(userID, table string, data map[string]any, whe
 			setParts = append(setParts, fmt.Sprintf("%s = ?", k))
 			args = append(args, data[k])
 		}
-		updateQ := fmt.Sprintf("UPDATE %s SET %s", table, strings.Join(setParts, ", "))
+		updateQ := fmt.Sprintf("UPDATE %s SET %s", ref, strings.Join(setParts, ", "))
 		processedWhere := convertILIKEtoLower(where)
 		whereClause, whereArgs, err := easyrest.BuildWhereClauseSorted(processedWhere)
 		if err != nil {
 			// Error in building WHERE clause, transaction will be rolled back
-			return 0, fmt.Errorf("failed to build WHERE: %w", err)
+			return 0, newDBError(errValidation, fmt.Errorf("failed to build WHERE: %w", err))
+		}
+		if policyCond != "" {
+			whereClause = appendCondition(whereClause, policyCond)
+			whereArgs = append(whereArgs, policyArgs...)
 		}
 		updateQ += whereClause
 		args = append(args, whereArgs...)
-		sqlRes, err := tx.ExecContext(context.Background(), updateQ, args...)
+		if explain {
+			plan, err := m.explainQuery(txCtx, tx, updateQ, args)
+			if err != nil {
+				return 0, err
+			}
+			return 0, planError(updateQ, args, plan)
+		}
+		key, err := m.audit.primaryKey(txCtx, tx, schema, object)
+		if err != nil {
+			return 0, err
+		}
+		before, err := m.audit.snapshot(txCtx, tx, ref, whereClause, whereArgs)
+		if err != nil {
+			return 0, err
+		}
+		start := time.Now()
+		queryCtx, span := m.startSpan(txCtx, "query", trace.WithAttributes(semconv.DBQueryText(updateQ)))
+		sqlRes, err := tx.ExecContext(queryCtx, updateQ, args...)
+		endSpan(span, err)
+		m.slowLog.log("TableUpdate", table, updateQ, args, start, rowsAffected(sqlRes), err)
 		if err != nil {
 			// Error during execution, transaction will be rolled back
 			return 0, fmt.Errorf("failed to execute update: %w", err)
@@ -814,6 +5179,13 @@ func (m *mysqlPlugin) TableUpdate(userID, table string, data map[string]any, whe
 			// Error getting affected rows, transaction will be rolled back
 			return 0, fmt.Errorf("failed to get rowsAffected: %w", err)
 		}
+		entries, err := m.audit.updatedImages(txCtx, tx, ref, key, before, data)
+		if err != nil {
+			return 0, err
+		}
+		if err := m.audit.write(txCtx, tx, userID, opUpdate, target, ctx, entries); err != nil {
+			return 0, err
+		}
 		// Return the number of affected rows (as int64 for safety, handleTransaction will convert if needed).
 		return int(affected), nil // Return as int directly
 	})
@@ -831,16 +5203,72 @@ func (m *mysqlPlugin) TableUpdate(userID, table string, data map[string]any, whe
 }
 
 // TableDelete builds and executes a DELETE statement.
-func (m *mysqlPlugin) TableDelete(userID, table string, where map[string]any, ctx map[string]any) (int, error) {
-	res, err := m.handleTransaction(ctx, func(tx *sql.Tx) (any, error) {
+// With the "explain" preference the statement is not executed and its plan is returned as a query_plan error.
+func (m *mysqlPlugin) TableDelete(userID, table string, where map[string]any, ctx map[string]any) (_ int, err error) {
+	defer m.metrics.observe("TableDelete", table, time.Now(), &err)
+	spanCtx, span := m.startOperation(ctx, "TableDelete", "DELETE", table)
+	defer func() { endSpan(span, err) }()
+	if err := m.access.checkTable(table, opDelete); err != nil {
+		return 0, err
+	}
+	if err := m.access.checkColumns(table, keysOf(where)...); err != nil {
+		return 0, err
+	}
+	if err := m.access.checkMasked(table, ctx, nil, keysOf(where)...); err != nil {
+		return 0, err
+	}
+	policyCond, policyArgs, err := m.access.policyCondition(table, "", opDelete, ctx)
+	if err != nil {
+		return 0, err
+	}
+	schema, object, err := m.resolve(ctx, table, "table")
+	if err != nil {
+		return 0, err
+	}
+	target, ref := qualify(schema, object), quoteQualified(schema, object)
+	explain, err := m.explainRequested(ctx)
+	if err != nil {
+		return 0, err
+	}
+	res, err := m.handleTransaction(spanCtx, ctx, func(txCtx context.Context, tx *sql.Tx) (any, error) {
 		processedWhere := convertILIKEtoLower(where)
 		whereClause, whereArgs, err := easyrest.BuildWhereClauseSorted(processedWhere)
 		if err != nil {
 			// Error in building WHERE clause, transaction will be rolled back
-			return 0, fmt.Errorf("failed to build WHERE: %w", err)
+			return 0, newDBError(errValidation, fmt.Errorf("failed to build WHERE: %w", err))
 		}
-		delQ := fmt.Sprintf("DELETE FROM %s%s", table, whereClause)
-		sqlRes, err := tx.ExecContext(context.Background(), delQ, whereArgs...)
+		var conds []string
+		if policyCond != "" {
+			conds = append(conds, policyCond)
+			whereArgs = append(whereArgs, policyArgs...)
+		}
+		cfg, softDelete := m.softDelete[table]
+		if softDelete {
+			// Already deleted rows are not touched again.
+			conds = append(conds, cfg.activeCondition(""))
+		}
+		whereClause = appendCondition(whereClause, conds...)
+		delQ := fmt.Sprintf("DELETE FROM %s%s", ref, whereClause)
+		if softDelete {
+			// Mark rows as deleted instead of removing them.
+			delQ = fmt.Sprintf("UPDATE %s SET %s%s", ref, cfg.deleteAssignment(), whereClause)
+		}
+		if explain {
+			plan, err := m.explainQuery(txCtx, tx, delQ, whereArgs)
+			if err != nil {
+				return 0, err
+			}
+			return 0, planError(delQ, whereArgs, plan)
+		}
+		before, err := m.audit.snapshot(txCtx, tx, ref, whereClause, whereArgs)
+		if err != nil {
+			return 0, err
+		}
+		start := time.Now()
+		queryCtx, span := m.startSpan(txCtx, "query", trace.WithAttributes(semconv.DBQueryText(delQ)))
+		sqlRes, err := tx.ExecContext(queryCtx, delQ, whereArgs...)
+		endSpan(span, err)
+		m.slowLog.log("TableDelete", table, delQ, whereArgs, start, rowsAffected(sqlRes), err)
 		if err != nil {
 			// Error during execution, transaction will be rolled back
 			return 0, fmt.Errorf("failed to execute delete: %w", err)
@@ -850,6 +5278,13 @@ func (m *mysqlPlugin) TableDelete(userID, table string, where map[string]any, ct
 			// Error getting affected rows, transaction will be rolled back
 			return 0, fmt.Errorf("failed to retrieve rowsAffected: %w", err)
 		}
+		entries := make([]auditEntry, 0, len(before))
+		for _, row := range before {
+			entries = append(entries, auditEntry{Before: row})
+		}
+		if err := m.audit.write(txCtx, tx, userID, opDelete, target, ctx, entries); err != nil {
+			return 0, err
+		}
 		// Return the number of affected rows (as int64 for safety, handleTransaction will convert if needed).
 		return int(affected), nil // Return as int directly
 	})
@@ -875,20 +5310,14 @@ type mysqlCachePlugin struct {
 // It relies on the underlying mysqlPlugin's InitConnection being called first or concurrently
 // by the plugin framework to establish the database connection.
 func (p *mysqlCachePlugin) InitConnection(uri string) error {
-	// Parse the URI to extract query parameters
-	parsedURL, err := url.Parse(uri)
+	// Parse the URI to extract query parameters; mysqlPlugin.InitConnection ignores autoCleanup.
+	parsedURI, err := parseMySQLURI(uri)
 	if err != nil {
 		return fmt.Errorf("failed to parse URI: %w", err)
 	}
 
 	// Get the autoCleanup query parameter
-	autoCleanup := parsedURL.Query().Get("autoCleanup")
-
-	// Remove the autoCleanup parameter from the URI
-	query := parsedURL.Query()
-	query.Del("autoCleanup")
-	parsedURL.RawQuery = query.Encode()
-	uri = parsedURL.String()
+	autoCleanup := parsedURI.Params.Get("autoCleanup")
 
 	// Ensure the underlying DB connection is initialized.
 	if p.dbPluginPointer.db == nil {
@@ -922,6 +5351,23 @@ func (p *mysqlCachePlugin) InitConnection(uri string) error {
 	return nil
 }
 
+// Close flushes buffered spans, stops the metrics listener and closes the connection pools.
+// It is called when the plugin process is shutting down.
+func (m *mysqlPlugin) Close() error {
+	m.shutdownTracer()
+	if m.metricsServer != nil {
+		m.metricsServer.Close()
+		m.metricsServer = nil
+	}
+	m.closeReplicas()
+	if m.db == nil {
+		return nil
+	}
+	err := m.db.Close()
+	m.db = nil
+	return err
+}
+
 // cleanupExpiredCacheEntries periodically deletes expired cache entries.
 func (p *mysqlCachePlugin) cleanupExpiredCacheEntries() {
 	ticker := time.NewTicker(1 * time.Minute)
@@ -975,10 +5421,12 @@ func (p *mysqlCachePlugin) Get(key string) (string, error) {
 	if err != nil {
 		// Return standard sql.ErrNoRows if not found or expired, otherwise the specific error
 		if errors.Is(err, sql.ErrNoRows) {
+			p.dbPluginPointer.metrics.cacheLookup(false)
 			return "", sql.ErrNoRows // Standard way to signal cache miss
 		}
 		return "", fmt.Errorf("failed to get cache entry: %w", err)
 	}
+	p.dbPluginPointer.metrics.cacheLookup(true)
 	return value, nil
 }
 
@@ -1000,4 +5448,8 @@ func main() {
 			"cache": &easyrest.CachePluginPlugin{Impl: cacheImpl}, // Register cache plugin
 		},
 	})
+	// Serve returns once EasyREST stops the plugin.
+	if err := impl.Close(); err != nil {
+		impl.log().Error("failed to close plugin", "error", err.Error())
+	}
 }